@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// vaultAddrAllowlist is a comma separated list of the Vault addresses vault-env may log in to,
+// set at build time with -ldflags "-X main.vaultAddrAllowlist=https://vault:8200" so pods can't
+// change it, VAULT_ADDR_ALLOWLIST restricts the addresses further at runtime
+var vaultAddrAllowlist string
+
+// normalizeVaultAddr returns addr as scheme://host:port/path so equivalent addresses compare equal
+func normalizeVaultAddr(addr string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(addr))
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q is not a http or https URL without credentials, query or fragment", addr)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return u.Scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port) + strings.TrimSuffix(u.Path, "/"), nil
+}
+
+// checkVaultAddr fails when addr is missing from the build time or the runtime allowlist,
+// the service account token must not be sent anywhere else
+func checkVaultAddr(addr string) error {
+	normalized, err := normalizeVaultAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid Vault address: %s", err.Error())
+	}
+
+	for _, allowlist := range []string{vaultAddrAllowlist, os.Getenv("VAULT_ADDR_ALLOWLIST")} {
+		if strings.TrimSpace(allowlist) == "" {
+			continue
+		}
+
+		allowed := false
+		for _, entry := range strings.Split(allowlist, ",") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			normalizedEntry, err := normalizeVaultAddr(entry)
+			if err != nil {
+				return fmt.Errorf("invalid Vault address allowlist: %s", err.Error())
+			}
+			if normalizedEntry == normalized {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Vault address %s is not in the allowlist", addr)
+		}
+	}
+	return nil
+}
+
+// vaultConfigFromEnv reads the Vault client config from the env and checks VAULT_ADDR and
+// VAULT_AGENT_ADDR against the allowlists, the client logs in at the agent address when set
+func vaultConfigFromEnv() (*vaultapi.Config, error) {
+	config := vaultapi.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("failed to read the Vault config: %s", config.Error.Error())
+	}
+	if err := checkVaultAddr(config.Address); err != nil {
+		return nil, err
+	}
+	if config.AgentAddress != "" {
+		if err := checkVaultAddr(config.AgentAddress); err != nil {
+			return nil, fmt.Errorf("VAULT_AGENT_ADDR: %s", err.Error())
+		}
+	}
+	return config, nil
+}
+
+// allowedVaultPaths returns the paths of VAULT_ALLOWED_PATHS, the ones the webhook policy
+// authorized at admission as <vault namespace>/<path>, nil when unset allows every path
+func allowedVaultPaths() map[string]bool {
+	value, ok := os.LookupEnv("VAULT_ALLOWED_PATHS")
+	if !ok {
+		return nil
+	}
+	allowed := map[string]bool{}
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.Trim(strings.TrimSpace(path), "/"); path != "" {
+			allowed[path] = true
+		}
+	}
+	return allowed
+}
+
+// checkVaultPath fails when the location, joined onto VAULT_NAMESPACE, isn't allowed, the env
+// and templates read from ConfigMaps and Secrets may have changed since the admission
+func checkVaultPath(allowed map[string]bool, location secretLocation) error {
+	if allowed == nil {
+		return nil
+	}
+	var segments []string
+	for _, segment := range []string{os.Getenv("VAULT_NAMESPACE"), location.namespace, location.path} {
+		if segment = strings.Trim(segment, "/"); segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if !allowed[strings.Join(segments, "/")] {
+		return fmt.Errorf("vault path %s was not authorized by the webhook policy when the pod was admitted", location)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/innovia/vault-env/vault"
+)
+
+// authenticatorFromEnv returns the authenticator of the VAULT_AUTH_METHOD auth method, kubernetes
+// if unset, VAULT_AUTH_PATH overrides the mount path of every method
+func authenticatorFromEnv() (vault.Authenticator, string, error) {
+	method := os.Getenv("VAULT_AUTH_METHOD")
+	authPath := os.Getenv("VAULT_AUTH_PATH")
+	role := os.Getenv("VAULT_ROLE")
+	// the projected token mounted by the webhook, the legacy service account token if unset
+	tokenFile := os.Getenv("VAULT_SA_TOKEN_FILE")
+
+	switch method {
+	case "", "kubernetes":
+		if role == "" {
+			return nil, "", fmt.Errorf("VAULT_ROLE environment variables is missing")
+		}
+		return &vault.KubernetesAuth{Path: authPath, Role: role, TokenFile: tokenFile}, "kubernetes", nil
+	case "jwt":
+		if role == "" {
+			return nil, "", fmt.Errorf("VAULT_ROLE environment variables is missing")
+		}
+		if jwtFile := os.Getenv("VAULT_JWT_FILE"); jwtFile != "" {
+			tokenFile = jwtFile
+		}
+		return &vault.JWTAuth{Path: authPath, Role: role, TokenFile: tokenFile}, method, nil
+	case "approle":
+		return &vault.AppRoleAuth{
+			Path:         authPath,
+			RoleIDFile:   os.Getenv("VAULT_ROLE_ID_FILE"),
+			SecretIDFile: os.Getenv("VAULT_SECRET_ID_FILE"),
+		}, method, nil
+	case "cert":
+		return &vault.CertAuth{Path: authPath, Role: role}, method, nil
+	case "token":
+		return &vault.TokenAuth{Token: os.Getenv("VAULT_TOKEN"), TokenFile: os.Getenv("VAULT_TOKEN_FILE")}, method, nil
+	default:
+		return nil, "", fmt.Errorf("Invalid VAULT_AUTH_METHOD %q, must be one of kubernetes, jwt, approle, cert, token", method)
+	}
+}
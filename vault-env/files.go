@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultFilesDir = "/vault/secrets"
+
+// secretFile is a file named name holding the value of ref
+type secretFile struct {
+	name string
+	ref  secretReference
+}
+
+// parseSecretFiles parses VAULT_FILES, a comma separated list of <name>=<path>#<key>
+func parseSecretFiles(value string, defaultPath string) ([]secretFile, error) {
+	var files []secretFile
+	if value == "" {
+		return files, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return nil, fmt.Errorf("invalid file entry %s, expected <name>=<path>#<key>", entry)
+		}
+		name := split[0]
+		if strings.Contains(name, "/") || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid file name %s", name)
+		}
+
+		ref, err := parseSecretReference(split[1], defaultPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file %s: %s", name, err.Error())
+		}
+		files = append(files, secretFile{name: name, ref: ref})
+	}
+	return files, nil
+}
+
+// parseFileOwner parses <uid>[:<gid>] or :<gid>, -1 keeps the current owner
+func parseFileOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return -1, -1, nil
+	}
+
+	split := strings.SplitN(owner, ":", 2)
+	uid, gid := -1, -1
+	var err error
+	if split[0] != "" || len(split) == 1 {
+		uid, err = strconv.Atoi(split[0])
+		if err != nil || uid < 0 {
+			return 0, 0, fmt.Errorf("invalid file owner %s, expected <uid>[:<gid>] or :<gid>", owner)
+		}
+	}
+	if len(split) == 2 {
+		gid, err = strconv.Atoi(split[1])
+		if err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("invalid file owner %s, expected <uid>[:<gid>] or :<gid>", owner)
+		}
+	}
+	return uid, gid, nil
+}
+
+// writeSecretFiles writes the files into dir with the given mode and owner,
+// files are renamed into place so readers never see partial content
+func writeSecretFiles(contents map[string][]byte, dir string, mode os.FileMode, owner string) error {
+	uid, gid, err := parseFileOwner(owner)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %s", dir, err.Error())
+	}
+
+	for name, content := range contents {
+		if err := writeFile(filepath.Join(dir, name), content, mode, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, content []byte, mode os.FileMode, uid int, gid int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %s", path, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file %s: %s", path, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file %s: %s", path, err.Error())
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return fmt.Errorf("failed to set mode of file %s: %s", path, err.Error())
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(tmp.Name(), uid, gid); err != nil {
+			return fmt.Errorf("failed to set owner of file %s: %s", path, err.Error())
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write file %s: %s", path, err.Error())
+	}
+
+	log.Infof("Wrote secret file %s", path)
+	return nil
+}
+
+// loadTemplates reads the file templates from VAULT_TEMPLATES, a JSON object of
+// file name to template, and from the files in VAULT_TEMPLATES_DIR
+func loadTemplates(inline string, dir string) (map[string]string, error) {
+	templates := map[string]string{}
+	if inline != "" {
+		if err := json.Unmarshal([]byte(inline), &templates); err != nil {
+			return nil, fmt.Errorf("invalid VAULT_TEMPLATES: %s", err.Error())
+		}
+	}
+
+	if dir != "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read templates directory %s: %s", dir, err.Error())
+		}
+		for _, entry := range entries {
+			// ConfigMap volumes hold their data in hidden directories and symlinks
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read template %s: %s", entry.Name(), err.Error())
+			}
+			templates[entry.Name()] = string(content)
+		}
+	}
+
+	for name := range templates {
+		if strings.Contains(name, "/") || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid template file name %s", name)
+		}
+	}
+	return templates, nil
+}
+
+// writeFilesFromEnv writes the files configured by VAULT_FILES* and
+// VAULT_TEMPLATES* env vars and returns how many were written
+func writeFilesFromEnv(path string, secrets *secretStore) (int, error) {
+	files, err := parseSecretFiles(os.Getenv("VAULT_FILES"), path)
+	if err != nil {
+		return 0, err
+	}
+
+	templates, err := loadTemplates(os.Getenv("VAULT_TEMPLATES"), os.Getenv("VAULT_TEMPLATES_DIR"))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(files) == 0 && len(templates) == 0 {
+		return 0, nil
+	}
+
+	contents := map[string][]byte{}
+	for _, file := range files {
+		value, err := secrets.getString(file.ref)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get file %s: %s", file.name, err.Error())
+		}
+		contents[file.name] = []byte(value)
+	}
+	for name, text := range templates {
+		rendered, err := renderTemplate(name, text, path, secrets)
+		if err != nil {
+			return 0, err
+		}
+		contents[name] = []byte(rendered)
+	}
+
+	dir := os.Getenv("VAULT_FILES_DIR")
+	if dir == "" {
+		dir = defaultFilesDir
+	}
+
+	mode := os.FileMode(0400)
+	if value := os.Getenv("VAULT_FILES_MODE"); value != "" {
+		parsed, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid VAULT_FILES_MODE %s, expected an octal mode like 0400", value)
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	if err := writeSecretFiles(contents, dir, mode, os.Getenv("VAULT_FILES_OWNER")); err != nil {
+		return 0, err
+	}
+	return len(contents), nil
+}
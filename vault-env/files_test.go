@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestParseSecretFiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expFiles []secretFile
+		expErr   bool
+	}{
+		{name: "no files", value: ""},
+		{
+			name:  "files with paths and with the default path",
+			value: "tls.key=secret/data/tls#key,.pgpass=pgpass",
+			expFiles: []secretFile{
+				{name: "tls.key", ref: secretReference{path: "secret/data/tls", key: "key"}},
+				{name: ".pgpass", ref: secretReference{path: "secret/data/app", key: "pgpass"}},
+			},
+		},
+		{
+			name:     "file of a child namespace",
+			value:    "db=secret/data/db#password?namespace=shared",
+			expFiles: []secretFile{{name: "db", ref: secretReference{path: "secret/data/db", key: "password", namespace: "shared"}}},
+		},
+		{name: "entry without a name", value: "=secret/data/tls#key", expErr: true},
+		{name: "entry without a reference", value: "tls.key", expErr: true},
+		{name: "name with a directory", value: "../tls.key=secret/data/tls#key", expErr: true},
+		{name: "parent directory name", value: "..=secret/data/tls#key", expErr: true},
+		{name: "invalid reference", value: "tls.key=secret/data/tls#", expErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			files, err := parseSecretFiles(testCase.value, "secret/data/app")
+			if testCase.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(files) != len(testCase.expFiles) {
+				t.Fatalf("expected files %v, got %v", testCase.expFiles, files)
+			}
+			for i, file := range files {
+				if file != testCase.expFiles[i] {
+					t.Errorf("expected file %v, got %v", testCase.expFiles[i], file)
+				}
+			}
+		})
+	}
+
+	if _, err := parseSecretFiles("tls.key=key", ""); err == nil {
+		t.Error("expected an error for a key without a path and VAULT_PATH")
+	}
+}
+
+func TestParseFileOwner(t *testing.T) {
+	testCases := []struct {
+		owner  string
+		expUID int
+		expGID int
+		expErr bool
+	}{
+		{owner: "", expUID: -1, expGID: -1},
+		{owner: "1000", expUID: 1000, expGID: -1},
+		{owner: "1000:2000", expUID: 1000, expGID: 2000},
+		{owner: ":2000", expUID: -1, expGID: 2000},
+		{owner: "app", expErr: true},
+		{owner: "1000:", expErr: true},
+		{owner: ":", expErr: true},
+		{owner: "-1:2000", expErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.owner, func(t *testing.T) {
+			uid, gid, err := parseFileOwner(testCase.owner)
+			if testCase.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got %d:%d", uid, gid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if uid != testCase.expUID || gid != testCase.expGID {
+				t.Errorf("expected %d:%d, got %d:%d", testCase.expUID, testCase.expGID, uid, gid)
+			}
+		})
+	}
+}
+
+func TestWriteSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// chown to the current user and group works without privileges
+	owner := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+	contents := map[string][]byte{"tls.key": []byte("key"), ".pgpass": []byte("pgpass")}
+	if err := writeSecretFiles(contents, filepath.Join(dir, "secrets"), 0440, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range contents {
+		file := filepath.Join(dir, "secrets", name)
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != 0440 {
+			t.Errorf("expected %s to have mode 0440, got %o", name, info.Mode())
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if int(stat.Uid) != os.Getuid() || int(stat.Gid) != os.Getgid() {
+			t.Errorf("expected %s to be owned by %s, got %d:%d", name, owner, stat.Uid, stat.Gid)
+		}
+		written, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != string(content) {
+			t.Errorf("expected %s to hold %q, got %q", name, content, written)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "secrets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(contents) {
+		t.Errorf("expected only the secret files, temporary files were left: %d entries", len(entries))
+	}
+
+	if err := writeSecretFiles(contents, dir, 0400, "app"); err == nil {
+		t.Error("expected an error for an invalid owner")
+	}
+}
@@ -9,11 +9,9 @@ import (
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
-
-	vaultapi "github.com/hashicorp/vault/api"
-	"github.com/spf13/cast"
 )
 
 type sanitizedEnviron []string
@@ -37,6 +35,29 @@ var sanitizeEnvmap = map[string]bool{
 	"VAULT_MFA":             true,
 	"VAULT_ROLE":            true,
 	"VAULT_PATH":            true,
+	"VAULT_AUTH_PATH":       true,
+	"VAULT_AUTH_METHOD":     true,
+	"VAULT_JWT_FILE":        true,
+	"VAULT_ROLE_ID_FILE":    true,
+	"VAULT_SECRET_ID_FILE":  true,
+	"VAULT_TOKEN_FILE":      true,
+	"VAULT_SA_TOKEN_FILE":   true,
+	"VAULT_ENV_SUPERVISE":   true,
+	"VAULT_WATCH_INTERVAL":  true,
+	"VAULT_WATCH_ACTION":    true,
+	"VAULT_WATCH_SIGNAL":    true,
+	"VAULT_STOP_TIMEOUT":    true,
+	"VAULT_FILES":           true,
+	"VAULT_FILES_DIR":       true,
+	"VAULT_FILES_MODE":      true,
+	"VAULT_FILES_OWNER":     true,
+	"VAULT_TEMPLATES":       true,
+	"VAULT_TEMPLATES_DIR":   true,
+	"VAULT_ENV_LOG_FORMAT":  true,
+	"VAULT_ENV_LOG_LEVEL":   true,
+	"VAULT_ADDR_ALLOWLIST":  true,
+	"VAULT_ALLOWED_PATHS":   true,
+	"VAULT_AGENT_ADDR":      true,
 }
 
 // Appends variable an entry (name=value) into the environ list.
@@ -48,74 +69,85 @@ func (environ *sanitizedEnviron) append(iname interface{}, ivalue interface{}) {
 	}
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
+// names returns the names of the env vars, the values must not be logged as they hold secrets
+func (environ sanitizedEnviron) names() []string {
+	names := make([]string, 0, len(environ))
+	for _, env := range environ {
+		names = append(names, strings.SplitN(env, "=", 2)[0])
+	}
+	return names
+}
 
-	role := os.Getenv("VAULT_ROLE")
-	path := os.Getenv("VAULT_PATH")
+// setupLogging configures the log format and level from VAULT_ENV_LOG_FORMAT and VAULT_ENV_LOG_LEVEL,
+// the json format matches the webhook logs
+func setupLogging() {
+	log.SetOutput(os.Stdout)
 
-	if role == "" {
-		log.Fatal("VAULT_ROLE environment variables is missing")
+	switch format := os.Getenv("VAULT_ENV_LOG_FORMAT"); format {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	default:
+		log.Fatalf("Invalid VAULT_ENV_LOG_FORMAT %q, must be json or text", format)
 	}
 
-	if path == "" {
-		log.Fatal("VAULT_PATH environment variables is missing")
+	if value := os.Getenv("VAULT_ENV_LOG_LEVEL"); value != "" {
+		level, err := log.ParseLevel(value)
+		if err != nil {
+			log.Fatalf("Invalid VAULT_ENV_LOG_LEVEL: %s", err.Error())
+		}
+		log.SetLevel(level)
 	}
+}
 
-	log.Infof("Logging into Vault Kubernetes backend using the role: %s", role)
-	client, err := vault.NewClientWithConfig(vaultapi.DefaultConfig(), role)
+func main() {
+	setupLogging()
 
+	path := os.Getenv("VAULT_PATH")
+
+	auth, method, err := authenticatorFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to create vault client: %s", err.Error())
+		log.Fatal(err.Error())
 	}
 
-	// initial and sanitized environs
-	environ := syscall.Environ()
-	sanitized := make(sanitizedEnviron, 0, len(environ))
+	config, err := vaultConfigFromEnv()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
-	// fetch the secrets from path
-	var secret *vaultapi.Secret
-	var secretError error
-	log.Infof("Getting Vault secrets from path: %s", path)
-	secret, secretError = client.Logical.Read(path)
-	if secretError != nil {
-		log.Fatalf("Failed to read secret '%s': %s", path, err.Error())
+	// the vault client sends VAULT_NAMESPACE with the login and every read
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		log.Infof("Logging into Vault namespace %s with the %s auth method", namespace, method)
+	} else {
+		log.Infof("Logging into Vault with the %s auth method", method)
 	}
-	if secret == nil {
-		log.Fatalf("Vault secret path not found: %s", path)
+	client, err := vault.NewClientWithAuthenticator(config, auth)
+	if err != nil {
+		log.Fatalf("Failed to create vault client: %s", err.Error())
 	}
 
-	log.Info("Processing environment variables from Vault secret")
-	for _, env := range environ {
-		split := strings.SplitN(env, "=", 2)
-		name := split[0]
-		value := split[1]
+	// fetch the secrets, every distinct path is read once
+	secrets := newSecretStore(client)
 
-		if strings.HasPrefix(value, "vault:") {
-			key := strings.TrimPrefix(value, "vault:")
-			var data map[string]interface{}
-			v2Data, ok := secret.Data["data"]
-			if ok {
-				data = cast.ToStringMap(v2Data)
-			} else {
-				data = cast.ToStringMap(secret.Data)
-			}
-			if value, ok := data[key]; ok {
-				sanitized.append(name, value)
-			} else {
-				fmt.Fprintf(os.Stderr, "key not found: %s", key)
-				os.Exit(1)
-			}
-		} else {
-			sanitized.append(name, value)
-		}
+	log.Info("Processing environment variables from Vault secrets")
+	sanitized, err := buildEnviron(syscall.Environ(), path, secrets)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
+	files, err := writeFilesFromEnv(path, secrets)
+	if err != nil {
+		log.Fatalf("Failed to write secret files: %s", err.Error())
 	}
+
 	log.Info("Launching command")
-	if len(os.Args) == 1 {
+	if len(os.Args) == 1 && (files > 0 || os.Getenv("VAULT_FILES_DIR") != "") {
+		// running as the files init container of the webhook, only the files were requested
+		log.Infof("Wrote %d secret files, no command given", files)
+	} else if len(os.Args) == 1 {
 		log.Fatal(
 			"No command is given, currently vault-env can't determine the entrypoint (command) ",
 			"please specify it explicitly",
@@ -125,11 +157,66 @@ func main() {
 		if err != nil {
 			log.Fatalf("Binary not found: %s", os.Args[1])
 		}
+
+		watch, err := parseWatchConfig()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		stopTimeout, err := parseStopTimeout()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		// watching secrets needs vault-env to stay alive next to the command
+		if supervise, _ := strconv.ParseBool(os.Getenv("VAULT_ENV_SUPERVISE")); supervise || watch != nil {
+			log.Debugf("Running command supervised: %s %s", binary, os.Args[1:])
+			supervisor := newSupervisor(client, secrets, path, binary, os.Args[1:], sanitized)
+			supervisor.watch = watch
+			supervisor.stopTimeout = stopTimeout
+			supervisor.login = func() (*vault.Client, error) {
+				log.Infof("Logging into Vault again with the %s auth method", method)
+				return vault.NewClientWithAuthenticator(config, auth)
+			}
+			os.Exit(supervisor.run())
+		}
+
 		log.Debugf("Running command using execv: %s %s", binary, os.Args[1:])
-		log.Debugf("Sanitized env: %s", sanitized)
+		log.Debugf("Passing env vars: %s", strings.Join(sanitized.names(), ", "))
 		err = syscall.Exec(binary, os.Args[1:], sanitized)
 		if err != nil {
 			log.Fatalf("Failed to exec process '%s': %s", binary, err.Error())
 		}
 	}
 }
+
+// buildEnviron resolve vault: references and vault-template: values in environ into a sanitized environ
+func buildEnviron(environ []string, path string, secrets *secretStore) (sanitizedEnviron, error) {
+	sanitized := make(sanitizedEnviron, 0, len(environ))
+
+	for _, env := range environ {
+		split := strings.SplitN(env, "=", 2)
+		name := split[0]
+		value := split[1]
+
+		if strings.HasPrefix(value, templatePrefix) {
+			rendered, err := renderTemplate(name, strings.TrimPrefix(value, templatePrefix), path, secrets)
+			if err != nil {
+				return nil, err
+			}
+			sanitized.append(name, rendered)
+		} else if strings.HasPrefix(value, vaultPrefix) {
+			ref, err := parseSecretReference(value, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %s", name, err.Error())
+			}
+			secretValue, err := secrets.getString(ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get %s: %s", name, err.Error())
+			}
+			sanitized.append(name, secretValue)
+		} else {
+			sanitized.append(name, value)
+		}
+	}
+	return sanitized, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/innovia/vault-env/vault"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// countingVault serves KV v1 secrets and counts the reads of each path
+type countingVault struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	secrets map[string]map[string]interface{}
+	reads   map[string]int
+}
+
+func newCountingVault(t *testing.T, secrets map[string]map[string]interface{}) *countingVault {
+	v := &countingVault{secrets: secrets, reads: map[string]int{}}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		path := r.URL.Path[len("/v1/"):]
+		v.reads[path]++
+		data, ok := v.secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			data = map[string]interface{}{"errors": []string{}}
+		} else {
+			data = map[string]interface{}{"data": data}
+		}
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			t.Error(err)
+		}
+	}))
+	return v
+}
+
+func (v *countingVault) client(t *testing.T) *vault.Client {
+	config := vaultapi.DefaultConfig()
+	config.Address = v.URL
+	config.MaxRetries = 0
+	rawClient, err := vaultapi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClient.SetToken("test-token")
+	return &vault.Client{Client: rawClient, Logical: rawClient.Logical()}
+}
+
+func TestParseSecretReference(t *testing.T) {
+	testCases := []struct {
+		value       string
+		defaultPath string
+		expRef      secretReference
+		expErr      bool
+	}{
+		{value: "vault:password", defaultPath: "secret/app", expRef: secretReference{path: "secret/app", key: "password"}},
+		{value: "vault:secret/db#password", defaultPath: "secret/app", expRef: secretReference{path: "secret/db", key: "password"}},
+		{value: "vault:secret/db#password", expRef: secretReference{path: "secret/db", key: "password"}},
+		{value: "vault:secret/db#pass#word", expRef: secretReference{path: "secret/db", key: "pass#word"}},
+		{value: "vault:secret/db#password?namespace=/shared/", expRef: secretReference{path: "secret/db", key: "password", namespace: "shared"}},
+		{value: "vault:password", expErr: true},
+		{value: "vault:#password", defaultPath: "secret/app", expErr: true},
+		{value: "vault:secret/db#", defaultPath: "secret/app", expErr: true},
+		{value: "vault:secret/db#password?namespace=", expErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.value, func(t *testing.T) {
+			ref, err := parseSecretReference(testCase.value, testCase.defaultPath)
+			if testCase.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ref != testCase.expRef {
+				t.Errorf("expected %+v, got %+v", testCase.expRef, ref)
+			}
+		})
+	}
+}
+
+func TestBuildEnviron(t *testing.T) {
+	v := newCountingVault(t, map[string]map[string]interface{}{
+		"secret/app": {"user": "app", "password": "app-password", "port": 5432, "debug": true},
+		"secret/db":  {"password": "db-password"},
+	})
+	defer v.Close()
+
+	environ, err := buildEnviron([]string{
+		"HOME=/root",
+		"DB_USER=vault:user",
+		"DB_PASSWORD=vault:secret/db#password",
+		"APP_PASSWORD=vault:secret/app#password",
+		"DB_PORT=vault:port",
+		"DEBUG=vault:secret/app#debug",
+		"DB_PASSWORD_AGAIN=vault:secret/db#password",
+	}, "secret/app", newSecretStore(v.client(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, env := range []string{
+		"HOME=/root",
+		"DB_USER=app",
+		"DB_PASSWORD=db-password",
+		"APP_PASSWORD=app-password",
+		"DB_PORT=5432",
+		"DEBUG=true",
+		"DB_PASSWORD_AGAIN=db-password",
+	} {
+		if !hasEnv(environ, env) {
+			t.Errorf("expected %s in %v", env, environ)
+		}
+	}
+	for path, reads := range v.reads {
+		if reads != 1 {
+			t.Errorf("expected %s to be read once, got %d reads", path, reads)
+		}
+	}
+	if len(v.reads) != 2 {
+		t.Errorf("expected secret/app and secret/db to be read, got %v", v.reads)
+	}
+}
+
+func TestBuildEnvironNonScalarValues(t *testing.T) {
+	v := newCountingVault(t, map[string]map[string]interface{}{
+		"secret/app": {
+			"config": map[string]interface{}{"user": "app"},
+			"hosts":  []string{"a", "b"},
+			"empty":  nil,
+		},
+	})
+	defer v.Close()
+
+	secrets := newSecretStore(v.client(t))
+	for _, env := range []string{"CONFIG=vault:config", "HOSTS=vault:hosts", "EMPTY=vault:empty", "MISSING=vault:missing"} {
+		t.Run(env, func(t *testing.T) {
+			if environ, err := buildEnviron([]string{env}, "secret/app", secrets); err == nil {
+				t.Errorf("expected an error, got %v", environ)
+			}
+		})
+	}
+}
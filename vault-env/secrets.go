@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/innovia/vault-env/vault"
+	log "github.com/sirupsen/logrus"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/spf13/cast"
+)
+
+const (
+	vaultPrefix = "vault:"
+	// namespaceSuffix reads a single reference from a child namespace of VAULT_NAMESPACE
+	namespaceSuffix = "?namespace="
+)
+
+// secretReference points to a key inside a Vault secret
+// env values are either vault:<key> (read from VAULT_PATH) or vault:<path>#<key>,
+// optionally followed by ?namespace=<namespace> to read from a child Vault Enterprise namespace
+type secretReference struct {
+	path      string
+	key       string
+	namespace string
+}
+
+func parseSecretReference(value string, defaultPath string) (secretReference, error) {
+	ref := strings.TrimPrefix(value, vaultPrefix)
+
+	namespace := ""
+	if i := strings.Index(ref, namespaceSuffix); i >= 0 {
+		namespace = strings.Trim(ref[i+len(namespaceSuffix):], "/")
+		ref = ref[:i]
+		if namespace == "" {
+			return secretReference{}, fmt.Errorf("invalid secret reference %s, empty namespace", value)
+		}
+	}
+
+	split := strings.SplitN(ref, "#", 2)
+	if len(split) == 1 {
+		if defaultPath == "" {
+			return secretReference{}, fmt.Errorf("no path given for key %s and VAULT_PATH is not set", ref)
+		}
+		return secretReference{path: defaultPath, key: ref, namespace: namespace}, nil
+	}
+
+	if split[0] == "" || split[1] == "" {
+		return secretReference{}, fmt.Errorf("invalid secret reference %s, expected vault:<path>#<key>", value)
+	}
+	return secretReference{path: split[0], key: split[1], namespace: namespace}, nil
+}
+
+// secretLocation is a Vault path in a namespace, the empty namespace is the one of the client
+type secretLocation struct {
+	namespace string
+	path      string
+}
+
+func (l secretLocation) String() string {
+	if l.namespace == "" {
+		return l.path
+	}
+	return l.namespace + "/" + l.path
+}
+
+// secretLease is a dynamic secret and the client to renew it with
+type secretLease struct {
+	client *vault.Client
+	secret *vaultapi.Secret
+}
+
+// secretStore reads every distinct Vault path only once
+type secretStore struct {
+	client  *vault.Client
+	secrets map[secretLocation]map[string]interface{}
+	// clients of the namespaces referenced explicitly
+	clients map[string]*vault.Client
+	// leases of dynamic secrets, renewed in supervisor mode
+	leases []secretLease
+	// KV v2 versions of the secrets, polled when watching
+	versions map[secretLocation]string
+	// allowedPaths are the paths authorized by the webhook policy, nil allows every path
+	allowedPaths map[string]bool
+}
+
+func newSecretStore(client *vault.Client) *secretStore {
+	return &secretStore{
+		client:       client,
+		secrets:      map[secretLocation]map[string]interface{}{},
+		clients:      map[string]*vault.Client{},
+		versions:     map[secretLocation]string{},
+		allowedPaths: allowedVaultPaths(),
+	}
+}
+
+// namespaceClient returns the client for namespace, the default client if it is empty
+func (s *secretStore) namespaceClient(namespace string) (*vault.Client, error) {
+	if namespace == "" {
+		return s.client, nil
+	}
+	if client, ok := s.clients[namespace]; ok {
+		return client, nil
+	}
+	client, err := s.client.WithNamespace(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for namespace '%s': %s", namespace, err.Error())
+	}
+	s.clients[namespace] = client
+	return client, nil
+}
+
+// data returns the key/values of the secret at path, KV v2 data is unwrapped
+func (s *secretStore) data(path string) (map[string]interface{}, error) {
+	return s.namespaceData("", path)
+}
+
+// namespaceData returns the key/values of the secret at path in namespace
+func (s *secretStore) namespaceData(namespace string, path string) (map[string]interface{}, error) {
+	location := secretLocation{namespace: namespace, path: path}
+	if err := checkVaultPath(s.allowedPaths, location); err != nil {
+		return nil, err
+	}
+	if data, ok := s.secrets[location]; ok {
+		return data, nil
+	}
+
+	client, err := s.namespaceClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Getting Vault secrets from path: %s", location)
+	secret, err := client.Logical.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret '%s': %s", location, err.Error())
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("vault secret path not found: %s", location)
+	}
+
+	if secret.LeaseID != "" {
+		s.leases = append(s.leases, secretLease{client: client, secret: secret})
+	}
+	if version := secretVersion(secret.Data); version != "" {
+		s.versions[location] = version
+	}
+
+	data := secretData(secret)
+	s.secrets[location] = data
+	return data, nil
+}
+
+// get returns the value of the referenced key
+func (s *secretStore) get(ref secretReference) (interface{}, error) {
+	data, err := s.namespaceData(ref.namespace, ref.path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := data[ref.key]
+	if !ok {
+		return nil, fmt.Errorf("key not found: %s in %s", ref.key, secretLocation{namespace: ref.namespace, path: ref.path})
+	}
+	return value, nil
+}
+
+// getString returns the value of the referenced key as a string, maps, lists and null
+// values can't be put in an env var or file and are errors instead of empty strings
+func (s *secretStore) getString(ref secretReference) (string, error) {
+	value, err := s.get(ref)
+	if err != nil {
+		return "", err
+	}
+	location := secretLocation{namespace: ref.namespace, path: ref.path}
+	if value == nil {
+		return "", fmt.Errorf("key %s in %s is null, expected a string, number or boolean", ref.key, location)
+	}
+	str, err := cast.ToStringE(value)
+	if err != nil {
+		return "", fmt.Errorf("key %s in %s is a %T, expected a string, number or boolean", ref.key, location, value)
+	}
+	return str, nil
+}
+
+func secretData(secret *vaultapi.Secret) map[string]interface{} {
+	if v2Data, ok := secret.Data["data"]; ok {
+		return cast.ToStringMap(v2Data)
+	}
+	return cast.ToStringMap(secret.Data)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/innovia/vault-env/vault"
+	log "github.com/sirupsen/logrus"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// defaultStopTimeout is how long a process stopped for a restart may take before it is killed
+const defaultStopTimeout = 30 * time.Second
+
+// supervisor runs the command as a child process instead of exec'ing it,
+// so vault-env stays alive to renew the Vault token and the secret leases
+// and to act on secret changes
+type supervisor struct {
+	client  *vault.Client
+	secrets *secretStore
+	path    string
+	binary  string
+	args    []string
+	environ []string
+	watch   *watchConfig
+	// login returns a new client when the token can't be renewed any more
+	login func() (*vault.Client, error)
+	// stopTimeout bounds how long the process may take to stop for a restart or exit
+	stopTimeout time.Duration
+
+	cmd           *exec.Cmd
+	signals       chan os.Signal
+	renewals      chan renewalStop
+	changes       chan string
+	tokenRenewal  *renewal
+	leaseRenewals []*renewal
+	watchStop     chan struct{}
+	kill          <-chan time.Time
+	restarting    bool
+	exiting       bool
+}
+
+// renewal is a running renewer, done is closed when it is stopped
+type renewal struct {
+	name    string
+	renewer *vaultapi.Renewer
+	done    chan struct{}
+}
+
+func (r *renewal) stop() {
+	close(r.done)
+	r.renewer.Stop()
+}
+
+func (r *renewal) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// renewalStop reports a token or lease that is no longer renewed
+type renewalStop struct {
+	renewal *renewal
+	err     error
+}
+
+func newSupervisor(client *vault.Client, secrets *secretStore, path string, binary string, args []string, environ []string) *supervisor {
+	return &supervisor{
+		client:   client,
+		secrets:  secrets,
+		path:     path,
+		binary:   binary,
+		args:     args,
+		environ:  environ,
+		signals:  make(chan os.Signal, 32),
+		renewals: make(chan renewalStop, 1),
+		changes:  make(chan string, 1),
+
+		stopTimeout: defaultStopTimeout,
+	}
+}
+
+// parseStopTimeout reads VAULT_STOP_TIMEOUT, the default stop timeout if unset
+func parseStopTimeout() (time.Duration, error) {
+	value := os.Getenv("VAULT_STOP_TIMEOUT")
+	if value == "" {
+		return defaultStopTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid VAULT_STOP_TIMEOUT %s", value)
+	}
+	return timeout, nil
+}
+
+// run starts the child and blocks until it exits, returning its exit code
+func (s *supervisor) run() int {
+	signal.Notify(s.signals)
+
+	if err := s.start(); err != nil {
+		log.Errorf("Failed to start process '%s': %s", s.binary, err.Error())
+		return 1
+	}
+
+	s.renewToken()
+	s.renewLeases()
+	s.startWatch()
+
+	for {
+		select {
+		case sig := <-s.signals:
+			switch sig {
+			case syscall.SIGCHLD:
+				if exited, code := s.reap(); exited {
+					s.kill = nil
+					if s.restarting {
+						s.restarting = false
+						if err := s.start(); err != nil {
+							log.Errorf("Failed to restart process '%s': %s", s.binary, err.Error())
+							return 1
+						}
+						continue
+					}
+					if s.exiting && code == 0 {
+						code = 1
+					}
+					return code
+				}
+			case syscall.SIGURG:
+				// used internally by the Go runtime for preemption
+			default:
+				s.signal(sig)
+			}
+		case stop := <-s.renewals:
+			if stop.renewal.stopped() {
+				continue
+			}
+			log.Warnf("Vault renewal of %s stopped: %s", stop.renewal.name, stop.err.Error())
+			s.refresh(stop.renewal == s.tokenRenewal)
+		case path := <-s.changes:
+			s.onChange(path)
+		case <-s.kill:
+			s.killProcess()
+		}
+	}
+}
+
+func (s *supervisor) start() error {
+	cmd := exec.Command(s.binary, s.args[1:]...)
+	cmd.Args[0] = s.args[0]
+	cmd.Env = s.environ
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Infof("Started process %d: %s", cmd.Process.Pid, s.binary)
+	s.cmd = cmd
+	return nil
+}
+
+func (s *supervisor) signal(sig os.Signal) {
+	log.Debugf("Forwarding signal %s to process %d", sig, s.cmd.Process.Pid)
+	if err := s.cmd.Process.Signal(sig); err != nil {
+		log.Warnf("Failed to forward signal %s: %s", sig, err.Error())
+	}
+}
+
+// onChange runs the configured watch action after the secret at path changed
+func (s *supervisor) onChange(path string) {
+	if s.restarting || s.exiting {
+		return
+	}
+	s.apply(s.watch.action)
+}
+
+// refresh gets new credentials after a renewal stopped, as the token or lease will expire,
+// the secrets are read again, after a new login if the token expires, and the command gets
+// them by the watch action, by a restart if no watch is configured
+func (s *supervisor) refresh(login bool) {
+	if s.restarting || s.exiting {
+		return
+	}
+
+	if login {
+		client, err := s.login()
+		if err != nil {
+			log.Errorf("Failed to log in to Vault again, stopping process %d to restart the container: %s", s.cmd.Process.Pid, err.Error())
+			s.apply(watchActionExit)
+			return
+		}
+		s.tokenRenewal.stop()
+		s.client = client
+		s.renewToken()
+	}
+
+	action := watchActionRestart
+	if s.watch != nil {
+		action = s.watch.action
+	}
+	s.apply(action)
+}
+
+// apply reads the secrets again and runs a watch action with them, the signal action restarts
+// the process instead when its env changed, it only reads the env at start
+func (s *supervisor) apply(action string) {
+	switch action {
+	case watchActionSignal, watchActionRestart:
+		secrets := newSecretStore(s.client)
+		environ, err := buildEnviron(syscall.Environ(), s.path, secrets)
+		if err != nil {
+			log.Errorf("Failed to refresh environment, keeping the current process: %s", err.Error())
+			return
+		}
+		if _, err := writeFilesFromEnv(s.path, secrets); err != nil {
+			log.Errorf("Failed to refresh secret files, keeping the current process: %s", err.Error())
+			return
+		}
+		s.replaceSecrets(secrets)
+		if action == watchActionSignal && equalEnviron(environ, s.environ) {
+			s.signal(s.watch.signal)
+			return
+		}
+		log.Infof("Restarting process %d with the new secrets", s.cmd.Process.Pid)
+		s.environ = environ
+		s.restarting = true
+		s.stop()
+	case watchActionExit:
+		log.Infof("Stopping process %d to restart the container", s.cmd.Process.Pid)
+		s.exiting = true
+		s.stop()
+	}
+}
+
+func equalEnviron(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stop asks the process to terminate and kills it if it is still running after the stop timeout
+func (s *supervisor) stop() {
+	s.signal(syscall.SIGTERM)
+	s.kill = time.After(s.stopTimeout)
+}
+
+func (s *supervisor) killProcess() {
+	s.kill = nil
+	log.Warnf("Process %d didn't stop within %s, killing it", s.cmd.Process.Pid, s.stopTimeout)
+	s.signal(syscall.SIGKILL)
+}
+
+// replaceSecrets renews and watches the leases and versions of secrets instead of the current ones
+func (s *supervisor) replaceSecrets(secrets *secretStore) {
+	for _, r := range s.leaseRenewals {
+		r.stop()
+	}
+	s.leaseRenewals = nil
+	s.stopWatch()
+
+	s.secrets = secrets
+	s.renewLeases()
+	s.startWatch()
+}
+
+func (s *supervisor) startWatch() {
+	if s.watch == nil || len(s.secrets.versions) == 0 {
+		return
+	}
+	versions := map[secretLocation]string{}
+	for location, version := range s.secrets.versions {
+		versions[location] = version
+	}
+	log.Infof("Watching %d secrets every %s, action on change: %s", len(versions), s.watch.interval, s.watch.action)
+	s.watchStop = make(chan struct{})
+	go watchSecrets(s.secrets, s.watch.interval, versions, s.changes, s.watchStop)
+}
+
+func (s *supervisor) stopWatch() {
+	if s.watchStop != nil {
+		close(s.watchStop)
+		s.watchStop = nil
+	}
+}
+
+// reap collects every exited child, as PID 1 this includes orphaned processes,
+// and reports whether the supervised process exited and its exit code
+func (s *supervisor) reap() (bool, int) {
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			return false, 0
+		}
+		if pid != s.cmd.Process.Pid {
+			log.Debugf("Reaped process %d", pid)
+			continue
+		}
+
+		code := status.ExitStatus()
+		if status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+		log.Infof("Process %d exited with code %d", pid, code)
+		return true, code
+	}
+}
+
+func (s *supervisor) renewToken() {
+	if s.client.Auth != nil {
+		s.tokenRenewal = s.renew(s.client, "token", s.client.Auth)
+	}
+}
+
+func (s *supervisor) renewLeases() {
+	for _, lease := range s.secrets.leases {
+		if r := s.renew(lease.client, lease.secret.LeaseID, lease.secret); r != nil {
+			s.leaseRenewals = append(s.leaseRenewals, r)
+		}
+	}
+}
+
+// renew keeps the token or lease of secret alive in the background, leases are
+// renewed with the client of the namespace they were issued in, renewals that stop
+// before the secret expires are reported on s.renewals
+func (s *supervisor) renew(client *vault.Client, name string, secret *vaultapi.Secret) *renewal {
+	renewer, err := client.Client.NewRenewer(&vaultapi.RenewerInput{Secret: secret})
+	if err != nil {
+		log.Warnf("Failed to create renewer for %s: %s", name, err.Error())
+		return nil
+	}
+	r := &renewal{name: name, renewer: renewer, done: make(chan struct{})}
+
+	go renewer.Renew()
+	go func() {
+		for {
+			select {
+			case err := <-renewer.DoneCh():
+				if r.stopped() {
+					return
+				}
+				if err == vaultapi.ErrRenewerNotRenewable {
+					// refresh before a secret that can't be renewed expires
+					ttl := leaseDuration(secret)
+					if ttl == 0 {
+						log.Debugf("%s is not renewable and doesn't expire", name)
+						return
+					}
+					log.Infof("%s is not renewable, refreshing it in %s", name, ttl*2/3)
+					select {
+					case <-time.After(ttl * 2 / 3):
+					case <-r.done:
+						return
+					}
+				} else if err == nil {
+					err = fmt.Errorf("reached its maximum TTL")
+				}
+				select {
+				case s.renewals <- renewalStop{renewal: r, err: err}:
+				case <-r.done:
+				}
+				return
+			case renewal := <-renewer.RenewCh():
+				log.Debugf("Renewed %s at %s", name, renewal.RenewedAt)
+			}
+		}
+	}()
+	return r
+}
+
+// leaseDuration returns the TTL of the token or lease of secret
+func leaseDuration(secret *vaultapi.Secret) time.Duration {
+	if secret.Auth != nil {
+		return time.Duration(secret.Auth.LeaseDuration) * time.Second
+	}
+	return time.Duration(secret.LeaseDuration) * time.Second
+}
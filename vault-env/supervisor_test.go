@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/innovia/vault-env/vault"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// fakeVault serves KV v2 reads of a single password and lease renewals
+type fakeVault struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	password string
+	version  int
+	renewTTL int
+	renewErr bool
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{password: "old", version: 1}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		var body interface{}
+		switch r.URL.Path {
+		case "/v1/secret/data/app":
+			body = map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"password": v.password},
+					"metadata": map[string]interface{}{"version": v.version},
+				},
+			}
+		case "/v1/sys/leases/renew":
+			if v.renewErr {
+				w.WriteHeader(http.StatusBadRequest)
+				body = map[string]interface{}{"errors": []string{"lease not found"}}
+				break
+			}
+			body = map[string]interface{}{"lease_id": "database/creds/app/1", "renewable": true, "lease_duration": v.renewTTL}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			body = map[string]interface{}{"errors": []string{}}
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			t.Error(err)
+		}
+	}))
+	return v
+}
+
+func (v *fakeVault) client(t *testing.T) *vault.Client {
+	config := vaultapi.DefaultConfig()
+	config.Address = v.URL
+	config.MaxRetries = 0
+	rawClient, err := vaultapi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClient.SetToken("test-token")
+	return &vault.Client{Client: rawClient, Logical: rawClient.Logical()}
+}
+
+func (v *fakeVault) rotate(password string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.password = password
+	v.version++
+}
+
+// newTestSupervisor runs sleep as the supervised command with the password in SECRET_PASSWORD
+func newTestSupervisor(t *testing.T, client *vault.Client) *supervisor {
+	os.Setenv("SECRET_PASSWORD", "vault:secret/data/app#password")
+
+	secrets := newSecretStore(client)
+	environ, err := buildEnviron([]string{"SECRET_PASSWORD=vault:secret/data/app#password"}, "", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSupervisor(client, secrets, "", "/bin/sleep", []string{"sleep", "30"}, environ)
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (s *supervisor) stopTest() {
+	os.Unsetenv("SECRET_PASSWORD")
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// notRenewableToken is a token renewal that never reports, like the renewal of a root token
+func notRenewableToken(t *testing.T, client *vault.Client) *renewal {
+	renewer, err := client.Client.NewRenewer(&vaultapi.RenewerInput{Secret: &vaultapi.Secret{Auth: &vaultapi.SecretAuth{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &renewal{name: "token", renewer: renewer, done: make(chan struct{})}
+}
+
+func hasEnv(environ []string, env string) bool {
+	for _, e := range environ {
+		if e == env {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSupervisorRefreshLogsInAgainAndRestarts(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+
+	s := newTestSupervisor(t, v.client(t))
+	defer s.stopTest()
+	oldToken := notRenewableToken(t, s.client)
+	s.tokenRenewal = oldToken
+
+	logins := 0
+	s.login = func() (*vault.Client, error) {
+		logins++
+		return v.client(t), nil
+	}
+
+	v.rotate("new")
+	s.refresh(true)
+
+	if logins != 1 {
+		t.Errorf("expected one login, got %d", logins)
+	}
+	if !oldToken.stopped() {
+		t.Error("expected the renewal of the old token to be stopped")
+	}
+	if !s.restarting {
+		t.Error("expected the process to be restarted without a watch config")
+	}
+	if !hasEnv(s.environ, "SECRET_PASSWORD=new") {
+		t.Errorf("expected the restarted process to get the new password, got %v", s.environ)
+	}
+}
+
+func TestSupervisorRefreshExitsWhenLoginFails(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+
+	s := newTestSupervisor(t, v.client(t))
+	defer s.stopTest()
+	s.tokenRenewal = notRenewableToken(t, s.client)
+	s.login = func() (*vault.Client, error) {
+		return nil, fmt.Errorf("permission denied")
+	}
+
+	s.refresh(true)
+
+	if !s.exiting || s.restarting {
+		t.Errorf("expected the container to be restarted, exiting %t restarting %t", s.exiting, s.restarting)
+	}
+}
+
+func TestSupervisorRefreshUsesWatchAction(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+
+	s := newTestSupervisor(t, v.client(t))
+	defer s.stopTest()
+	s.watch = &watchConfig{interval: time.Hour, action: watchActionExit}
+
+	s.refresh(false)
+
+	if !s.exiting {
+		t.Error("expected the exit watch action to run")
+	}
+}
+
+func TestSupervisorSignalActionRestartsWhenEnvChanges(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+
+	s := newTestSupervisor(t, v.client(t))
+	defer s.stopTest()
+	s.watch = &watchConfig{interval: time.Hour, action: watchActionSignal, signal: syscall.SIGUSR1}
+	environ, err := buildEnviron(syscall.Environ(), "", newSecretStore(s.client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.environ = environ
+
+	s.apply(watchActionSignal)
+	if s.restarting {
+		t.Error("expected a signal while the env is unchanged")
+	}
+
+	v.rotate("new")
+	s.apply(watchActionSignal)
+	if !s.restarting {
+		t.Error("expected a restart as the password is passed in the env")
+	}
+	if !hasEnv(s.environ, "SECRET_PASSWORD=new") {
+		t.Errorf("expected the restarted process to get the new password, got %v", s.environ)
+	}
+}
+
+func TestRenewReportsLeasesThatStop(t *testing.T) {
+	testCases := []struct {
+		name     string
+		renewErr bool
+		expErr   string
+	}{
+		{name: "max TTL", expErr: "reached its maximum TTL"},
+		{name: "renewal error", renewErr: true, expErr: "lease not found"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			v := newFakeVault(t)
+			defer v.Close()
+			v.renewErr = testCase.renewErr
+
+			s := newSupervisor(v.client(t), nil, "", "", nil, nil)
+			lease := &vaultapi.Secret{LeaseID: "database/creds/app/1", LeaseDuration: 60, Renewable: true}
+			r := s.renew(s.client, lease.LeaseID, lease)
+			if r == nil {
+				t.Fatal("expected a renewal")
+			}
+
+			select {
+			case stop := <-s.renewals:
+				if stop.renewal != r {
+					t.Error("expected the stop of the lease renewal")
+				}
+				if !strings.Contains(stop.err.Error(), testCase.expErr) {
+					t.Errorf("expected error %q, got %q", testCase.expErr, stop.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the renewal to stop")
+			}
+		})
+	}
+}
+
+func TestRenewIgnoresStoppedRenewals(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+	v.renewTTL = 3600
+
+	s := newSupervisor(v.client(t), nil, "", "", nil, nil)
+	lease := &vaultapi.Secret{LeaseID: "database/creds/app/1", LeaseDuration: 3600, Renewable: true}
+	r := s.renew(s.client, lease.LeaseID, lease)
+	if r == nil {
+		t.Fatal("expected a renewal")
+	}
+	r.stop()
+
+	select {
+	case stop := <-s.renewals:
+		t.Errorf("expected no report for a stopped renewal, got %s", stop.err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestSupervisorKillsProcessIgnoringSIGTERM(t *testing.T) {
+	s := newSupervisor(nil, newSecretStore(nil), "", "/bin/sh", []string{"sh", "-c", `trap "" TERM; while true; do sleep 1; done`}, nil)
+	s.stopTimeout = 100 * time.Millisecond
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.cmd.Process.Kill()
+	// give the shell time to install the trap
+	time.Sleep(200 * time.Millisecond)
+
+	s.apply(watchActionExit)
+
+	select {
+	case <-s.kill:
+		s.killProcess()
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stop timeout to expire")
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- s.cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err == nil || !strings.Contains(err.Error(), "killed") {
+			t.Errorf("expected the process to be killed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the process to exit after SIGKILL")
+	}
+}
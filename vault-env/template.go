@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"text/template"
+
+	"github.com/spf13/cast"
+)
+
+// env values starting with vault-template: are rendered as Go templates
+const templatePrefix = "vault-template:"
+
+// templateFuncs are the helpers available in templates, the webhook validates templates
+// at admission time against a stub list of the same names
+func templateFuncs(secrets *secretStore) template.FuncMap {
+	return template.FuncMap{
+		"secret": func(path string) (map[string]interface{}, error) {
+			return secrets.data(path)
+		},
+		"b64enc": func(value interface{}) string {
+			return base64.StdEncoding.EncodeToString([]byte(cast.ToString(value)))
+		},
+		"b64dec": func(value interface{}) (string, error) {
+			decoded, err := base64.StdEncoding.DecodeString(cast.ToString(value))
+			return string(decoded), err
+		},
+		"toJSON": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+		"fromJSON": func(value interface{}) (interface{}, error) {
+			var decoded interface{}
+			err := json.Unmarshal([]byte(cast.ToString(value)), &decoded)
+			return decoded, err
+		},
+		// pemEncode wraps DER bytes, e.g. from b64dec, in a PEM block of the given type
+		"pemEncode": func(blockType string, value interface{}) string {
+			return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: []byte(cast.ToString(value))}))
+		},
+		// pemDecode returns the DER bytes of the first PEM block
+		"pemDecode": func(value interface{}) (string, error) {
+			block, _ := pem.Decode([]byte(cast.ToString(value)))
+			if block == nil {
+				return "", fmt.Errorf("no PEM data found")
+			}
+			return string(block.Bytes), nil
+		},
+	}
+}
+
+// renderTemplate renders text with the secret at path as data,
+// other secrets are available through the secret function
+func renderTemplate(name string, text string, path string, secrets *secretStore) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs(secrets)).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %s", name, err.Error())
+	}
+
+	data := map[string]interface{}{}
+	if path != "" {
+		data, err = secrets.data(path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %s", name, err.Error())
+	}
+	return rendered.String(), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/pem"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// webhookTemplates is the webhook's copy of the template helpers used for admission checks
+const webhookTemplates = "../vault-secrets-webhook/webhookmain/templates.go"
+
+// webhookTemplateFuncs returns the keys of the webhook's templateFuncs map
+func webhookTemplateFuncs(t *testing.T) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), webhookTemplates, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.ValueSpec)
+		if !ok || len(spec.Names) != 1 || spec.Names[0].Name != "templateFuncs" || len(spec.Values) != 1 {
+			return true
+		}
+		literal, ok := spec.Values[0].(*ast.CompositeLit)
+		if !ok {
+			t.Fatalf("expected templateFuncs in %s to be a map literal", webhookTemplates)
+		}
+		for _, element := range literal.Elts {
+			key := element.(*ast.KeyValueExpr).Key.(*ast.BasicLit)
+			name, err := strconv.Unquote(key.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		return false
+	})
+	sort.Strings(names)
+	return names
+}
+
+func TestTemplateFuncsMatchWebhook(t *testing.T) {
+	// vault-env is also built on its own, without the webhook next to it
+	if _, err := os.Stat(webhookTemplates); os.IsNotExist(err) {
+		t.Skipf("%s is not checked out", webhookTemplates)
+	}
+
+	var names []string
+	for name := range templateFuncs(nil) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	webhookNames := webhookTemplateFuncs(t)
+	if len(webhookNames) == 0 {
+		t.Fatalf("found no templateFuncs in %s", webhookTemplates)
+	}
+	if strings.Join(names, ",") != strings.Join(webhookNames, ",") {
+		t.Errorf("template helpers of vault-env %v and the webhook %v differ, update %s", names, webhookNames, webhookTemplates)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("der-bytes")}))
+
+	secrets := newSecretStore(nil)
+	secrets.secrets[secretLocation{path: "secret/data/app"}] = map[string]interface{}{
+		"password":    "s3cret",
+		"encoded":     "czNjcmV0",
+		"config":      map[string]interface{}{"port": 5432},
+		"json":        `{"host": "db", "port": 5432}`,
+		"certificate": certificate,
+	}
+	secrets.secrets[secretLocation{path: "secret/data/db"}] = map[string]interface{}{"user": "app"}
+
+	testCases := []struct {
+		name        string
+		text        string
+		expRendered string
+		expErr      bool
+	}{
+		{name: "data of the path", text: "password={{ .password }}", expRendered: "password=s3cret"},
+		{name: "secret function", text: `{{ (secret "secret/data/db").user }}`, expRendered: "app"},
+		{name: "b64enc", text: "{{ .password | b64enc }}", expRendered: "czNjcmV0"},
+		{name: "b64dec", text: "{{ .encoded | b64dec }}", expRendered: "s3cret"},
+		{name: "invalid base64", text: "{{ .password | b64dec }}", expErr: true},
+		{name: "toJSON", text: "{{ toJSON .config }}", expRendered: `{"port":5432}`},
+		{name: "fromJSON", text: "{{ (fromJSON .json).host }}", expRendered: "db"},
+		{name: "pemEncode", text: `{{ "der-bytes" | b64enc | b64dec | pemEncode "CERTIFICATE" }}`, expRendered: certificate},
+		{name: "pemDecode", text: "{{ pemDecode .certificate }}", expRendered: "der-bytes"},
+		{name: "pemDecode without PEM data", text: "{{ pemDecode .password }}", expErr: true},
+		{name: "missing key", text: "{{ .username }}", expErr: true},
+		{name: "unknown function", text: "{{ .password | upper }}", expErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rendered, err := renderTemplate(testCase.name, testCase.text, "secret/data/app", secrets)
+			if testCase.expErr {
+				if err == nil {
+					t.Errorf("expected an error, got %q", rendered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rendered != testCase.expRendered {
+				t.Errorf("expected %q, got %q", testCase.expRendered, rendered)
+			}
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 
 const (
 	serviceAccountFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// DefaultAuthPath is the mount path of the Kubernetes auth method
+	DefaultAuthPath = "auth/kubernetes"
 )
 
 type vaultConfig struct {
@@ -20,6 +22,8 @@ type vaultConfig struct {
 type Client struct {
 	Client  *vaultapi.Client
 	Logical *vaultapi.Logical
+	// Auth is the login secret holding the client token and its lease
+	Auth *vaultapi.Secret
 }
 
 // GetServiceAccountToken read Kubernetes service account token
@@ -33,16 +37,19 @@ func GetServiceAccountToken() ([]byte, error) {
 	return jwt, nil
 }
 
-// GetVaultClientToken Authenticate to Vault
+// Login Authenticate to Vault with the auth method mounted at authPath and return the login secret
+func Login(client *Client, authPath string, role string, jwt []byte) (*vaultapi.Secret, error) {
+	return writeLogin(client, authPath, map[string]interface{}{"jwt": string(jwt), "role": role})
+}
+
+// GetVaultClientToken Authenticate to Vault with the auth method mounted at DefaultAuthPath,
+// use Login for the auth path set in VAULT_AUTH_PATH
 func GetVaultClientToken(client *Client, role string, jwt []byte) (string, error) {
-	params := map[string]interface{}{"jwt": string(jwt), "role": role}
-	secretData, err := client.Logical.Write("auth/kubernetes/login", params)
+	secretData, err := Login(client, DefaultAuthPath, role, jwt)
 	if err != nil {
-		log.Errorf("Failed to request new Vault token", err.Error())
 		return "", err
 	}
-	clientToken := &secretData.Auth.ClientToken
-	return *clientToken, nil
+	return secretData.Auth.ClientToken, nil
 }
 
 // NewClient new vault client
@@ -52,25 +59,10 @@ func NewClient(role string) (*Client, error) {
 
 // NewClientWithConfig create a new vault client
 func NewClientWithConfig(config *vaultapi.Config, role string) (*Client, error) {
-	rawClient, err := vaultapi.NewClient(config)
-	if err != nil {
-		return nil, err
-	}
-	logical := rawClient.Logical()
-	client := &Client{Client: rawClient, Logical: logical}
-
-	jwt, err := GetServiceAccountToken()
-	if err != nil {
-		return nil, err
-	}
-
-	clientToken, err := GetVaultClientToken(client, role, jwt)
+	return NewClientWithAuthPath(config, DefaultAuthPath, role)
+}
 
-	if err == nil {
-		rawClient.SetToken(string(clientToken))
-	} else {
-		return nil, err
-	}
-	return client, nil
-	// caCertPath := os.Getenv(vaultapi.EnvVaultCACert)
+// NewClientWithAuthPath create a new vault client logged in with the auth method mounted at authPath
+func NewClientWithAuthPath(config *vaultapi.Config, authPath string, role string) (*Client, error) {
+	return NewClientWithAuthenticator(config, &KubernetesAuth{Path: authPath, Role: role})
 }
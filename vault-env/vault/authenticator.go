@@ -0,0 +1,192 @@
+package vault
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// default mount paths of the auth methods
+const (
+	DefaultJWTAuthPath     = "auth/jwt"
+	DefaultAppRoleAuthPath = "auth/approle"
+	DefaultCertAuthPath    = "auth/cert"
+)
+
+// Authenticator logs a client in to Vault
+type Authenticator interface {
+	// Login returns the login secret holding the client token and its lease
+	Login(client *Client) (*vaultapi.Secret, error)
+}
+
+// KubernetesAuth logs in with the service account token of the pod
+type KubernetesAuth struct {
+	// Path is the mount path of the auth method, DefaultAuthPath if empty
+	Path string
+	Role string
+	// TokenFile holds the service account token, the default service account token mount if empty
+	TokenFile string
+}
+
+// Login implements Authenticator
+func (a *KubernetesAuth) Login(client *Client) (*vaultapi.Secret, error) {
+	jwt, err := readCredential("service account token", withDefault(a.TokenFile, serviceAccountFile))
+	if err != nil {
+		return nil, err
+	}
+	return Login(client, withDefault(a.Path, DefaultAuthPath), a.Role, jwt)
+}
+
+// JWTAuth logs in to a JWT/OIDC auth method with a JWT read from a file, e.g. a service
+// account token issued for the cluster OIDC issuer
+type JWTAuth struct {
+	// Path is the mount path of the auth method, DefaultJWTAuthPath if empty
+	Path string
+	Role string
+	// TokenFile holds the JWT, the default service account token mount if empty
+	TokenFile string
+}
+
+// Login implements Authenticator
+func (a *JWTAuth) Login(client *Client) (*vaultapi.Secret, error) {
+	jwt, err := readCredential("JWT", withDefault(a.TokenFile, serviceAccountFile))
+	if err != nil {
+		return nil, err
+	}
+	return Login(client, withDefault(a.Path, DefaultJWTAuthPath), a.Role, jwt)
+}
+
+// AppRoleAuth logs in with a role_id and secret_id read from files
+type AppRoleAuth struct {
+	// Path is the mount path of the auth method, DefaultAppRoleAuthPath if empty
+	Path         string
+	RoleIDFile   string
+	SecretIDFile string
+}
+
+// Login implements Authenticator
+func (a *AppRoleAuth) Login(client *Client) (*vaultapi.Secret, error) {
+	roleID, err := readCredential("AppRole role_id", a.RoleIDFile)
+	if err != nil {
+		return nil, err
+	}
+	secretID, err := readCredential("AppRole secret_id", a.SecretIDFile)
+	if err != nil {
+		return nil, err
+	}
+	return writeLogin(client, withDefault(a.Path, DefaultAppRoleAuthPath), map[string]interface{}{
+		"role_id":   string(roleID),
+		"secret_id": string(secretID),
+	})
+}
+
+// CertAuth logs in with the TLS client certificate of the client configuration,
+// see VAULT_CLIENT_CERT and VAULT_CLIENT_KEY
+type CertAuth struct {
+	// Path is the mount path of the auth method, DefaultCertAuthPath if empty
+	Path string
+	// Role is the certificate role to log in with, Vault tries all of them if empty
+	Role string
+}
+
+// Login implements Authenticator
+func (a *CertAuth) Login(client *Client) (*vaultapi.Secret, error) {
+	params := map[string]interface{}{}
+	if a.Role != "" {
+		params["name"] = a.Role
+	}
+	return writeLogin(client, withDefault(a.Path, DefaultCertAuthPath), params)
+}
+
+// TokenAuth uses a pre-issued token, read from TokenFile if set
+type TokenAuth struct {
+	Token     string
+	TokenFile string
+}
+
+// Login implements Authenticator, the token is looked up to learn whether it can be renewed
+func (a *TokenAuth) Login(client *Client) (*vaultapi.Secret, error) {
+	token := a.Token
+	if a.TokenFile != "" {
+		data, err := readCredential("Vault token", a.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = string(data)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no Vault token given")
+	}
+
+	client.Client.SetToken(token)
+	self, err := client.Client.Auth().Token().LookupSelf()
+	if err != nil {
+		log.Errorf("Failed to look up the Vault token: %s", err.Error())
+		return nil, err
+	}
+	renewable, err := self.TokenIsRenewable()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := self.TokenTTL()
+	if err != nil {
+		return nil, err
+	}
+	return &vaultapi.Secret{Auth: &vaultapi.SecretAuth{
+		ClientToken:   token,
+		Renewable:     renewable,
+		LeaseDuration: int(ttl.Seconds()),
+	}}, nil
+}
+
+// NewClientWithAuthenticator create a new vault client logged in with auth
+func NewClientWithAuthenticator(config *vaultapi.Config, auth Authenticator) (*Client, error) {
+	rawClient, err := vaultapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{Client: rawClient, Logical: rawClient.Logical()}
+
+	authSecret, err := auth.Login(client)
+	if err != nil {
+		return nil, err
+	}
+	rawClient.SetToken(authSecret.Auth.ClientToken)
+	client.Auth = authSecret
+	return client, nil
+}
+
+// writeLogin logs in at the login endpoint of the auth method mounted at authPath
+func writeLogin(client *Client, authPath string, params map[string]interface{}) (*vaultapi.Secret, error) {
+	secretData, err := client.Logical.Write(strings.Trim(authPath, "/")+"/login", params)
+	if err != nil {
+		log.Errorf("Failed to request new Vault token: %s", err.Error())
+		return nil, err
+	}
+	if secretData == nil || secretData.Auth == nil {
+		return nil, fmt.Errorf("no auth info returned by Vault login")
+	}
+	return secretData, nil
+}
+
+func readCredential(name string, file string) ([]byte, error) {
+	if file == "" {
+		return nil, fmt.Errorf("no %s file given", name)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Errorf("Failed to read %s file: %s", name, err.Error())
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(data))), nil
+}
+
+func withDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
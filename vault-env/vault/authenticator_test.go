@@ -0,0 +1,202 @@
+package vault
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// loginServer records the login requests and answers them with the token test-token
+type loginServer struct {
+	*httptest.Server
+
+	path   string
+	params map[string]interface{}
+	token  string
+}
+
+func newLoginServer(t *testing.T) *loginServer {
+	s := &loginServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			s.path = r.URL.Path
+			s.token = r.Header.Get("X-Vault-Token")
+			body = map[string]interface{}{"data": map[string]interface{}{"renewable": true, "ttl": 3600}}
+		default:
+			s.path = r.URL.Path
+			s.params = map[string]interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&s.params); err != nil {
+				t.Error(err)
+			}
+			body = map[string]interface{}{"auth": map[string]interface{}{"client_token": "test-token", "renewable": true, "lease_duration": 3600}}
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			t.Error(err)
+		}
+	}))
+	return s
+}
+
+func (s *loginServer) client(t *testing.T) *Client {
+	config := vaultapi.DefaultConfig()
+	config.Address = s.URL
+	config.MaxRetries = 0
+	rawClient, err := vaultapi.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClient.ClearToken()
+	return &Client{Client: rawClient, Logical: rawClient.Logical()}
+}
+
+// writeCredential writes data with a trailing newline, like files mounted from a Secret often have
+func writeCredential(t *testing.T, dir string, name string, data string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(data+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestAuthenticatorsLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwtFile := writeCredential(t, dir, "jwt", "header.payload.signature")
+	roleIDFile := writeCredential(t, dir, "role-id", "app-role-id")
+	secretIDFile := writeCredential(t, dir, "secret-id", "app-secret-id")
+
+	testCases := []struct {
+		name      string
+		auth      Authenticator
+		expPath   string
+		expParams map[string]interface{}
+	}{
+		{
+			name:      "Kubernetes auth should send the token file and role",
+			auth:      &KubernetesAuth{Path: "auth/k8s-prod", Role: "app", TokenFile: jwtFile},
+			expPath:   "/v1/auth/k8s-prod/login",
+			expParams: map[string]interface{}{"jwt": "header.payload.signature", "role": "app"},
+		}, {
+			name:      "JWT auth should default to the jwt mount path",
+			auth:      &JWTAuth{Role: "app", TokenFile: jwtFile},
+			expPath:   "/v1/auth/jwt/login",
+			expParams: map[string]interface{}{"jwt": "header.payload.signature", "role": "app"},
+		}, {
+			name:      "AppRole auth should send the trimmed role_id and secret_id",
+			auth:      &AppRoleAuth{RoleIDFile: roleIDFile, SecretIDFile: secretIDFile},
+			expPath:   "/v1/auth/approle/login",
+			expParams: map[string]interface{}{"role_id": "app-role-id", "secret_id": "app-secret-id"},
+		}, {
+			name:      "Cert auth should send the certificate role",
+			auth:      &CertAuth{Path: "/auth/cert-eu/", Role: "web"},
+			expPath:   "/v1/auth/cert-eu/login",
+			expParams: map[string]interface{}{"name": "web"},
+		}, {
+			name:      "Cert auth should let Vault pick the role without one",
+			auth:      &CertAuth{},
+			expPath:   "/v1/auth/cert/login",
+			expParams: map[string]interface{}{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := newLoginServer(t)
+			defer s.Close()
+
+			secret, err := testCase.auth.Login(s.client(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secret.Auth.ClientToken != "test-token" {
+				t.Errorf("expected the login token, got %q", secret.Auth.ClientToken)
+			}
+			if s.path != testCase.expPath {
+				t.Errorf("expected a login at %s, got %s", testCase.expPath, s.path)
+			}
+			if len(s.params) != len(testCase.expParams) {
+				t.Errorf("expected login params %v, got %v", testCase.expParams, s.params)
+			}
+			for key, value := range testCase.expParams {
+				if s.params[key] != value {
+					t.Errorf("expected login param %s %q, got %q", key, value, s.params[key])
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticatorsMissingCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	roleIDFile := writeCredential(t, dir, "role-id", "app-role-id")
+
+	testCases := []struct {
+		name string
+		auth Authenticator
+	}{
+		{name: "missing token file", auth: &KubernetesAuth{Role: "app", TokenFile: filepath.Join(dir, "missing")}},
+		{name: "missing JWT file", auth: &JWTAuth{Role: "app", TokenFile: filepath.Join(dir, "missing")}},
+		{name: "no secret_id file", auth: &AppRoleAuth{RoleIDFile: roleIDFile}},
+		{name: "missing secret_id file", auth: &AppRoleAuth{RoleIDFile: roleIDFile, SecretIDFile: filepath.Join(dir, "missing")}},
+		{name: "no token", auth: &TokenAuth{}},
+		{name: "missing Vault token file", auth: &TokenAuth{TokenFile: filepath.Join(dir, "missing")}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := newLoginServer(t)
+			defer s.Close()
+
+			if _, err := testCase.auth.Login(s.client(t)); err == nil {
+				t.Error("expected an error")
+			}
+			if s.path != "" {
+				t.Errorf("expected no request to Vault, got %s", s.path)
+			}
+		})
+	}
+}
+
+func TestTokenAuthLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newLoginServer(t)
+	defer s.Close()
+
+	auth := &TokenAuth{Token: "ignored-token", TokenFile: writeCredential(t, dir, "token", "file-token")}
+	client, err := NewClientWithAuthenticator(&vaultapi.Config{Address: s.URL, HttpClient: s.Client()}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.token != "file-token" {
+		t.Errorf("expected the token of the file to be looked up, got %q", s.token)
+	}
+	if client.Client.Token() != "file-token" {
+		t.Errorf("expected the client to use the token of the file, got %q", client.Client.Token())
+	}
+	if !client.Auth.Auth.Renewable || client.Auth.Auth.LeaseDuration != 3600 {
+		t.Errorf("expected a renewable token with a TTL of 3600s, got %+v", client.Auth.Auth)
+	}
+}
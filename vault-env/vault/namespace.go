@@ -0,0 +1,22 @@
+package vault
+
+import "strings"
+
+// namespaceHeader carries the Vault Enterprise namespace of a request, set from VAULT_NAMESPACE
+const namespaceHeader = "X-Vault-Namespace"
+
+// WithNamespace returns a client sending the token of c to the Vault Enterprise namespace,
+// used to read secrets outside of the namespace set in VAULT_NAMESPACE. The namespace is
+// relative to the one of c, like the token of c is only valid there and in its children
+func (c *Client) WithNamespace(namespace string) (*Client, error) {
+	rawClient, err := c.Client.Clone()
+	if err != nil {
+		return nil, err
+	}
+	rawClient.SetToken(c.Client.Token())
+	if parent := strings.Trim(c.Client.Headers().Get(namespaceHeader), "/"); parent != "" {
+		namespace = parent + "/" + strings.Trim(namespace, "/")
+	}
+	rawClient.SetNamespace(namespace)
+	return &Client{Client: rawClient, Logical: rawClient.Logical()}, nil
+}
@@ -0,0 +1,43 @@
+package vault
+
+import (
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+func TestWithNamespace(t *testing.T) {
+	testCases := []struct {
+		name         string
+		parent       string
+		namespace    string
+		expNamespace string
+	}{
+		{name: "root namespace", namespace: "shared", expNamespace: "shared"},
+		{name: "child of the client namespace", parent: "org/", namespace: "/shared", expNamespace: "org/shared"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rawClient, err := vaultapi.NewClient(&vaultapi.Config{Address: "http://127.0.0.1:8200"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testCase.parent != "" {
+				rawClient.SetNamespace(testCase.parent)
+			}
+			rawClient.SetToken("test-token")
+
+			client, err := (&Client{Client: rawClient}).WithNamespace(testCase.namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if namespace := client.Client.Headers().Get(namespaceHeader); namespace != testCase.expNamespace {
+				t.Errorf("expected namespace %q, got %q", testCase.expNamespace, namespace)
+			}
+			if client.Client.Token() != "test-token" {
+				t.Errorf("expected the token of the parent client, got %q", client.Client.Token())
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	watchActionSignal  = "signal"
+	watchActionRestart = "restart"
+	watchActionExit    = "exit"
+)
+
+var watchSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// watchConfig is read from VAULT_WATCH_* env vars
+type watchConfig struct {
+	interval time.Duration
+	action   string
+	signal   syscall.Signal
+}
+
+func parseWatchConfig() (*watchConfig, error) {
+	interval := os.Getenv("VAULT_WATCH_INTERVAL")
+	if interval == "" {
+		return nil, nil
+	}
+
+	// the process only reads its env at start, secret files and templates can be reloaded
+	// on a signal
+	config := &watchConfig{action: watchActionRestart, signal: syscall.SIGHUP}
+	if os.Getenv("VAULT_FILES") != "" || os.Getenv("VAULT_TEMPLATES") != "" {
+		config.action = watchActionSignal
+	}
+
+	var err error
+	config.interval, err = time.ParseDuration(interval)
+	if err != nil || config.interval <= 0 {
+		return nil, fmt.Errorf("invalid VAULT_WATCH_INTERVAL %s", interval)
+	}
+
+	if action := os.Getenv("VAULT_WATCH_ACTION"); action != "" {
+		switch action {
+		case watchActionSignal, watchActionRestart, watchActionExit:
+			config.action = action
+		default:
+			return nil, fmt.Errorf("invalid VAULT_WATCH_ACTION %s, expected one of signal, restart, exit", action)
+		}
+	}
+
+	if name := os.Getenv("VAULT_WATCH_SIGNAL"); name != "" {
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		signal, ok := watchSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported VAULT_WATCH_SIGNAL %s", name)
+		}
+		config.signal = signal
+	}
+
+	return config, nil
+}
+
+// watchSecrets polls the KV v2 secrets in versions and sends the location on changes
+// when the version stored in the secret metadata changes, until stop is closed
+func watchSecrets(secrets *secretStore, interval time.Duration, versions map[secretLocation]string, changes chan<- string, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for location, version := range versions {
+			client, ok := secrets.clients[location.namespace]
+			if !ok {
+				client = secrets.client
+			}
+			secret, err := client.Logical.Read(location.path)
+			if err != nil || secret == nil {
+				log.Warnf("Failed to poll secret '%s': %v", location, err)
+				continue
+			}
+
+			current := secretVersion(secret.Data)
+			if current != "" && current != version {
+				log.Infof("Secret '%s' changed from version %s to %s", location, version, current)
+				versions[location] = current
+				select {
+				case changes <- location.String():
+				case <-stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+// secretVersion returns the KV v2 version of the secret data or an empty string
+func secretVersion(data map[string]interface{}) string {
+	metadata, ok := data["metadata"]
+	if !ok {
+		return ""
+	}
+	return cast.ToString(cast.ToStringMap(metadata)["version"])
+}
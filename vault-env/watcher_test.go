@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseWatchConfig(t *testing.T) {
+	testCases := []struct {
+		name      string
+		env       map[string]string
+		expConfig *watchConfig
+		expErr    bool
+	}{
+		{
+			name: "No interval should disable watching",
+		}, {
+			name:      "Defaults should restart the process",
+			env:       map[string]string{"VAULT_WATCH_INTERVAL": "1m"},
+			expConfig: &watchConfig{interval: time.Minute, action: watchActionRestart, signal: syscall.SIGHUP},
+		}, {
+			name:      "Defaults should signal SIGHUP with secret files",
+			env:       map[string]string{"VAULT_WATCH_INTERVAL": "1m", "VAULT_FILES": "config=secret/data/app#config"},
+			expConfig: &watchConfig{interval: time.Minute, action: watchActionSignal, signal: syscall.SIGHUP},
+		}, {
+			name:      "Defaults should signal SIGHUP with templates",
+			env:       map[string]string{"VAULT_WATCH_INTERVAL": "1m", "VAULT_TEMPLATES": "config"},
+			expConfig: &watchConfig{interval: time.Minute, action: watchActionSignal, signal: syscall.SIGHUP},
+		}, {
+			name:      "Signals should be accepted without the SIG prefix",
+			env:       map[string]string{"VAULT_WATCH_INTERVAL": "30s", "VAULT_WATCH_ACTION": "signal", "VAULT_WATCH_SIGNAL": "usr1"},
+			expConfig: &watchConfig{interval: 30 * time.Second, action: watchActionSignal, signal: syscall.SIGUSR1},
+		}, {
+			name:      "Restart action should be accepted",
+			env:       map[string]string{"VAULT_WATCH_INTERVAL": "30s", "VAULT_WATCH_ACTION": "restart"},
+			expConfig: &watchConfig{interval: 30 * time.Second, action: watchActionRestart, signal: syscall.SIGHUP},
+		}, {
+			name:   "Invalid intervals should be rejected",
+			env:    map[string]string{"VAULT_WATCH_INTERVAL": "-1m"},
+			expErr: true,
+		}, {
+			name:   "Unknown actions should be rejected",
+			env:    map[string]string{"VAULT_WATCH_INTERVAL": "1m", "VAULT_WATCH_ACTION": "reload"},
+			expErr: true,
+		}, {
+			name:   "Unsupported signals should be rejected",
+			env:    map[string]string{"VAULT_WATCH_INTERVAL": "1m", "VAULT_WATCH_SIGNAL": "SIGKILL"},
+			expErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for _, name := range []string{"VAULT_WATCH_INTERVAL", "VAULT_WATCH_ACTION", "VAULT_WATCH_SIGNAL", "VAULT_FILES", "VAULT_TEMPLATES"} {
+				os.Unsetenv(name)
+			}
+			for name, value := range testCase.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+
+			config, err := parseWatchConfig()
+			if testCase.expErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testCase.expConfig == nil {
+				if config != nil {
+					t.Errorf("expected no watch config, got %+v", config)
+				}
+				return
+			}
+			if config == nil || *config != *testCase.expConfig {
+				t.Errorf("expected %+v, got %+v", testCase.expConfig, config)
+			}
+		})
+	}
+}
+
+func TestParseStopTimeout(t *testing.T) {
+	defer os.Unsetenv("VAULT_STOP_TIMEOUT")
+
+	os.Unsetenv("VAULT_STOP_TIMEOUT")
+	if timeout, err := parseStopTimeout(); err != nil || timeout != defaultStopTimeout {
+		t.Errorf("expected the default stop timeout, got %s %v", timeout, err)
+	}
+
+	os.Setenv("VAULT_STOP_TIMEOUT", "5s")
+	if timeout, err := parseStopTimeout(); err != nil || timeout != 5*time.Second {
+		t.Errorf("expected 5s, got %s %v", timeout, err)
+	}
+
+	os.Setenv("VAULT_STOP_TIMEOUT", "0s")
+	if _, err := parseStopTimeout(); err == nil {
+		t.Error("expected an error for a zero timeout")
+	}
+}
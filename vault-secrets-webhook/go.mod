@@ -3,12 +3,17 @@ module github.com/innovia/vault-secrets-webhook
 go 1.12
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-test/deep v1.0.1
 	github.com/gogo/protobuf v1.2.1 // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/google/gofuzz v1.0.0 // indirect
 	github.com/googleapis/gnostic v0.2.0 // indirect
+	github.com/hashicorp/golang-lru v0.5.1 // indirect
 	github.com/json-iterator/go v1.1.6 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/prometheus/client_golang v0.9.0-pre1.0.20180924113449-f69c853d21c1
+	github.com/sirupsen/logrus v1.4.1
 	github.com/slok/kubewebhook v0.2.0
 	github.com/spf13/viper v1.3.2
 	github.com/stretchr/testify v1.2.2
@@ -20,6 +25,7 @@ require (
 	k8s.io/apimachinery v0.0.0-20190313205120-d7deff9243b1
 	k8s.io/client-go v11.0.0+incompatible
 	k8s.io/klog v0.3.0 // indirect
+	k8s.io/kube-openapi v0.0.0-20190228160746-b3a7cee44a30 // indirect
 	k8s.io/utils v0.0.0-20190308190857-21c4ce38f2a7 // indirect
-	sigs.k8s.io/yaml v1.1.0 // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -2,9 +2,28 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/innovia/vault-secrets-webhook/webhookmain"
 )
 
 func main() {
+	// KRM function runners start the container without arguments, the krm image target runs the binary as vault-secrets-krm
+	if filepath.Base(os.Args[0]) == "vault-secrets-krm" {
+		webhookmain.KRMMain()
+		return
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inject":
+			webhookmain.InjectMain(os.Args[2:])
+			return
+		case "krm":
+			webhookmain.KRMMain()
+			return
+		}
+	}
 	webhookmain.Main()
 }
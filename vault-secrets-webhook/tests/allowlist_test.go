@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVaultEnvInjectionVaultAddrAllowlist(t *testing.T) {
+	wh.InitConfig()
+	viper.Set("vault_addr_allowlist", "https://vault.vault.svc.cluster.local:8200, http://vault-dev:8200/")
+	defer viper.Set("vault_addr_allowlist", "")
+
+	tests := []struct {
+		name      string
+		addr      string
+		agentAddr string
+		allowed   bool
+	}{
+		{name: "listed address", addr: "https://vault.vault.svc.cluster.local:8200", allowed: true},
+		{name: "listed address with an upper case host", addr: "http://VAULT-DEV:8200", allowed: true},
+		{name: "listed address with trailing slash", addr: "https://vault.vault.svc.cluster.local:8200/", allowed: true},
+		{name: "unlisted address", addr: "https://vault.attacker.example.com:8200"},
+		{name: "listed host with another scheme", addr: "http://vault.vault.svc.cluster.local:8200"},
+		{name: "listed host with another port", addr: "https://vault.vault.svc.cluster.local"},
+		{name: "address with credentials", addr: "https://user@vault.vault.svc.cluster.local:8200"},
+		{name: "unlisted agent address", addr: "https://vault.vault.svc.cluster.local:8200", agentAddr: "https://vault.attacker.example.com"},
+		{name: "listed agent address", addr: "https://vault.vault.svc.cluster.local:8200", agentAddr: "http://vault-dev:8200", allowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := newVaultPod("test-pod-with-vault-addr", map[string]string{"vault.security/vault-addr": test.addr})
+			if test.agentAddr != "" {
+				pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_AGENT_ADDR", Value: test.agentAddr})
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if !test.allowed {
+				assert.Error(err)
+				return
+			}
+			if assert.NoError(err) {
+				assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{
+					Name:  "VAULT_ADDR_ALLOWLIST",
+					Value: "https://vault.vault.svc.cluster.local:8200, http://vault-dev:8200/",
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/slok/kubewebhook/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertWatcherReload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "vault-secrets-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = wh.NewCertWatcher(filepath.Join(dir, "servingCert"), filepath.Join(dir, "servingKey"), &log.Std{})
+	assert.Error(err, "a missing initial key pair is an error")
+
+	firstExpiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	certFile, keyFile := writeKeyPair(t, dir, firstExpiry)
+	watcher, err := wh.NewCertWatcher(certFile, keyFile, &log.Std{})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(firstExpiry.Equal(watcher.NotAfter()))
+	first, _ := watcher.GetCertificate(&tls.ClientHelloInfo{})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if !assert.NoError(watcher.Start(stopCh)) {
+		return
+	}
+
+	t.Log("Checking a rotated key pair is served")
+	secondExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	writeKeyPair(t, dir, secondExpiry)
+	assert.True(eventually(func() bool { return secondExpiry.Equal(watcher.NotAfter()) }), "rotated certificate was not loaded")
+	second, _ := watcher.GetCertificate(&tls.ClientHelloInfo{})
+	assert.NotEqual(first.Certificate[0], second.Certificate[0])
+
+	t.Log("Checking a broken key pair keeps the current certificate")
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	current, _ := watcher.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Equal(second.Certificate[0], current.Certificate[0])
+	assert.True(secondExpiry.Equal(watcher.NotAfter()))
+}
+
+// eventually polls condition for up to 5 seconds
+func eventually(condition func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return condition()
+}
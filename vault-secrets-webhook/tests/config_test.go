@@ -0,0 +1,366 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVaultConfigPrecedence(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "team-b",
+			Annotations: map[string]string{
+				"vault.security/vault-addr":      "https://vault.team-b.svc.cluster.local:8200",
+				"vault.security/vault-path":      "secret/data/team-b/shared",
+				"vault.security/vault-auth-path": "auth/k8s-prod-eu",
+			},
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := wh.StartNamespaceInformer(client, stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := map[string]string{
+		"default_vault_addr":            "https://vault.default.svc.cluster.local:8200",
+		"default_vault_auth_path":       "auth/k8s-prod",
+		"default_vault_tls_secret_name": "vault-ca",
+		"default_vault_role_template":   "{{ .Namespace }}-{{ .ServiceAccountName }}",
+		"default_vault_path_template":   "secret/data/{{ .Namespace }}/{{ .Name }}",
+	}
+
+	testCases := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		expEnv      []corev1.EnvVar
+		expTLS      string
+	}{
+		{
+			name:      "Webhook defaults should be used when only vault.security/enabled is set",
+			namespace: "default",
+			annotations: map[string]string{
+				"vault.security/enabled": "true",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_ADDR", Value: "https://vault.default.svc.cluster.local:8200"},
+				{Name: "VAULT_PATH", Value: "secret/data/default/app"},
+				{Name: "VAULT_ROLE", Value: "default-app-sa"},
+				{Name: "VAULT_AUTH_PATH", Value: "auth/k8s-prod"},
+			},
+			expTLS: "vault-ca",
+		}, {
+			name:      "Namespace annotations should override webhook defaults",
+			namespace: "team-b",
+			annotations: map[string]string{
+				"vault.security/enabled": "true",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_ADDR", Value: "https://vault.team-b.svc.cluster.local:8200"},
+				{Name: "VAULT_PATH", Value: "secret/data/team-b/shared"},
+				{Name: "VAULT_ROLE", Value: "team-b-app-sa"},
+				{Name: "VAULT_AUTH_PATH", Value: "auth/k8s-prod-eu"},
+			},
+			expTLS: "vault-ca",
+		}, {
+			name:      "Pod annotations should override namespace annotations and webhook defaults",
+			namespace: "team-b",
+			annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.pod.svc.cluster.local:8200",
+				"vault.security/vault-path":            "secret/data/pod",
+				"vault.security/vault-role":            "pod-role",
+				"vault.security/vault-tls-secret-name": "pod-ca",
+				"vault.security/vault-auth-path":       "auth/k8s-pod",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_ADDR", Value: "https://vault.pod.svc.cluster.local:8200"},
+				{Name: "VAULT_PATH", Value: "secret/data/pod"},
+				{Name: "VAULT_ROLE", Value: "pod-role"},
+				{Name: "VAULT_AUTH_PATH", Value: "auth/k8s-pod"},
+			},
+			expTLS: "pod-ca",
+		},
+	}
+
+	wh.InitConfig()
+	for key, value := range defaults {
+		viper.Set(key, value)
+		defer viper.Set(key, "")
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: "app-",
+					Namespace:    testCase.namespace,
+					Annotations:  testCase.annotations,
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: "app-sa",
+					Containers: []corev1.Container{
+						{
+							Name:    "alpine",
+							Image:   "alpine",
+							Command: []string{"user-command"},
+							Env: []corev1.EnvVar{
+								{
+									Name:  "AWS_SECRET_ACCESS_KEY",
+									Value: "vault:AWS_SECRET_ACCESS_KEY",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if assert.NoError(err) {
+				for _, env := range testCase.expEnv {
+					assert.Contains(pod.Spec.Containers[0].Env, env)
+				}
+				assert.Equal(testCase.expTLS, pod.Spec.Volumes[1].Secret.SecretName)
+			}
+		})
+	}
+}
+
+func TestVaultConfigWorkloadName(t *testing.T) {
+	controller := true
+	testCases := []struct {
+		name    string
+		meta    metav1.ObjectMeta
+		expPath string
+	}{
+		{
+			name: "Pods of a Deployment should be named after the Deployment",
+			meta: metav1.ObjectMeta{
+				GenerateName:    "app-5d8f7c9b4-",
+				Labels:          map[string]string{"pod-template-hash": "5d8f7c9b4"},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-5d8f7c9b4", Controller: &controller}},
+			},
+			expPath: "secret/data/default/app",
+		}, {
+			name: "Pods of a StatefulSet should be named after the StatefulSet",
+			meta: metav1.ObjectMeta{
+				Name:            "db-0",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &controller}},
+			},
+			expPath: "secret/data/default/db",
+		}, {
+			name:    "Pods without a controller should use their generateName",
+			meta:    metav1.ObjectMeta{GenerateName: "job-"},
+			expPath: "secret/data/default/job",
+		},
+	}
+
+	wh.InitConfig()
+	viper.Set("default_vault_path_template", "secret/data/{{ .Namespace }}/{{ .Name }}")
+	defer viper.Set("default_vault_path_template", "")
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			meta := testCase.meta
+			meta.Namespace = "default"
+			meta.Annotations = map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: meta,
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "alpine",
+							Image:   "alpine",
+							Command: []string{"user-command"},
+							Env: []corev1.EnvVar{
+								{Name: "AWS_SECRET_ACCESS_KEY", Value: "vault:AWS_SECRET_ACCESS_KEY"},
+							},
+						},
+					},
+				},
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if assert.NoError(err) {
+				assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_PATH", Value: testCase.expPath})
+			}
+		})
+	}
+}
+
+func TestVaultConfigAuthPath(t *testing.T) {
+	testCases := []struct {
+		authPath string
+		valid    bool
+	}{
+		{authPath: "auth/kubernetes", valid: true},
+		{authPath: "auth/k8s-prod-eu", valid: true},
+		{authPath: "/auth/clusters/prod_eu.1/", valid: true},
+		{authPath: "k8s-prod-eu"},
+		{authPath: "auth/"},
+		{authPath: "auth/../sys"},
+		{authPath: "auth//kubernetes"},
+		{authPath: "auth/kubernetes/login?role=x"},
+	}
+
+	wh.InitConfig()
+	for _, testCase := range testCases {
+		t.Run(testCase.authPath, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-pod-with-auth-path",
+					Namespace: "default",
+					Annotations: map[string]string{
+						"vault.security/enabled":               "true",
+						"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+						"vault.security/vault-role":            "some-role",
+						"vault.security/vault-path":            "/secret/some/path",
+						"vault.security/vault-tls-secret-name": "vault-consul-ca",
+						"vault.security/vault-auth-path":       testCase.authPath,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "alpine",
+							Image:   "alpine",
+							Command: []string{"user-command"},
+							Env: []corev1.EnvVar{
+								{Name: "AWS_SECRET_ACCESS_KEY", Value: "vault:AWS_SECRET_ACCESS_KEY"},
+							},
+						},
+					},
+				},
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestVaultConfigAuthMethod(t *testing.T) {
+	testCases := []struct {
+		name          string
+		annotations   map[string]string
+		defaultMethod string
+		expEnv        []corev1.EnvVar
+		expErr        bool
+	}{
+		{
+			name: "AppRole auth should not require a role nor use the default Kubernetes auth path",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method":      "approle",
+				"vault.security/vault-auth-secret-name": "vault-approle",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_AUTH_METHOD", Value: "approle"},
+				{Name: "VAULT_ROLE", Value: ""},
+			},
+		}, {
+			name:          "The webhook default auth method should be used",
+			defaultMethod: "token",
+			annotations:   map[string]string{"vault.security/vault-token-file": "/var/run/secrets/vault-token/token"},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_AUTH_METHOD", Value: "token"},
+			},
+		}, {
+			name: "JWT auth should use the role and auth path annotations",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method": "jwt",
+				"vault.security/vault-auth-path":   "auth/oidc-eu",
+				"vault.security/vault-role":        "app",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_AUTH_METHOD", Value: "jwt"},
+				{Name: "VAULT_AUTH_PATH", Value: "auth/oidc-eu"},
+				{Name: "VAULT_ROLE", Value: "app"},
+			},
+		}, {
+			name:        "JWT auth should require a role",
+			annotations: map[string]string{"vault.security/vault-auth-method": "jwt"},
+			expErr:      true,
+		}, {
+			name:        "Unknown auth methods should be rejected",
+			annotations: map[string]string{"vault.security/vault-auth-method": "ldap"},
+			expErr:      true,
+		},
+	}
+
+	wh.InitConfig()
+	viper.Set("default_vault_auth_path", "auth/k8s-prod")
+	defer viper.Set("default_vault_auth_path", "")
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			viper.Set("default_vault_auth_method", testCase.defaultMethod)
+			defer viper.Set("default_vault_auth_method", "")
+
+			annotations := map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			}
+			for key, value := range testCase.annotations {
+				annotations[key] = value
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pod-with-auth-method",
+					Namespace:   "default",
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "alpine",
+							Image:   "alpine",
+							Command: []string{"user-command"},
+							Env: []corev1.EnvVar{
+								{Name: "AWS_SECRET_ACCESS_KEY", Value: "vault:AWS_SECRET_ACCESS_KEY"},
+							},
+						},
+					},
+				},
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.expErr {
+				assert.Error(err)
+				return
+			}
+			if assert.NoError(err) {
+				env := pod.Spec.Containers[0].Env
+				for _, expEnv := range testCase.expEnv {
+					assert.Contains(env, expEnv)
+				}
+				if testCase.annotations["vault.security/vault-auth-path"] == "" {
+					for _, e := range env {
+						assert.NotEqual("VAULT_AUTH_PATH", e.Name)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVaultEnvInjectionAuthCredentials(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expEnv      []corev1.EnvVar
+		expSecret   string
+		expErr      bool
+	}{
+		{
+			name: "AppRole credentials should default to keys of the auth secret",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method":      "approle",
+				"vault.security/vault-auth-secret-name": "vault-approle",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_ROLE_ID_FILE", Value: "/var/run/secrets/vault-auth/role-id"},
+				{Name: "VAULT_SECRET_ID_FILE", Value: "/var/run/secrets/vault-auth/secret-id"},
+			},
+			expSecret: "vault-approle",
+		}, {
+			name: "Client certificates should be read from the annotated keys of the auth secret",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method":      "cert",
+				"vault.security/vault-auth-secret-name": "vault-client-tls",
+				"vault.security/vault-client-cert-file": "client.pem",
+				"vault.security/vault-client-key-file":  "client-key.pem",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_CLIENT_CERT", Value: "/var/run/secrets/vault-auth/client.pem"},
+				{Name: "VAULT_CLIENT_KEY", Value: "/var/run/secrets/vault-auth/client-key.pem"},
+			},
+			expSecret: "vault-client-tls",
+		}, {
+			name: "Absolute token files should be used without an auth secret",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method": "token",
+				"vault.security/vault-token-file":  "/etc/vault/token",
+			},
+			expEnv: []corev1.EnvVar{{Name: "VAULT_TOKEN_FILE", Value: "/etc/vault/token"}},
+		}, {
+			name: "JWT auth should use the service account token without a JWT file",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method": "jwt",
+			},
+		}, {
+			name: "AppRole auth without credentials should be rejected",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method": "approle",
+			},
+			expErr: true,
+		}, {
+			name: "Credentials of another auth method should be rejected",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method":  "token",
+				"vault.security/vault-token-file":   "/etc/vault/token",
+				"vault.security/vault-role-id-file": "/etc/vault/role-id",
+			},
+			expErr: true,
+		}, {
+			name: "Relative files without an auth secret should be rejected",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method": "token",
+				"vault.security/vault-token-file":  "token",
+			},
+			expErr: true,
+		}, {
+			name: "Relative files outside the auth secret should be rejected",
+			annotations: map[string]string{
+				"vault.security/vault-auth-method":      "token",
+				"vault.security/vault-auth-secret-name": "vault-token",
+				"vault.security/vault-token-file":       "../vault/token",
+			},
+			expErr: true,
+		}, {
+			name: "Auth secrets should be rejected for the kubernetes auth method",
+			annotations: map[string]string{
+				"vault.security/vault-auth-secret-name": "vault-token",
+			},
+			expErr: true,
+		},
+	}
+
+	wh.InitConfig()
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := newVaultPod("test-pod-with-auth-credentials", testCase.annotations)
+			pod.Annotations["vault.security/file.config"] = "secret/data/app#config"
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.expErr {
+				assert.Error(err)
+				return
+			}
+			if !assert.NoError(err) {
+				return
+			}
+
+			authMount := corev1.VolumeMount{Name: "vault-auth", MountPath: "/var/run/secrets/vault-auth", ReadOnly: true}
+			// the files init container logs in too
+			for _, container := range []corev1.Container{pod.Spec.Containers[0], pod.Spec.InitContainers[1]} {
+				for _, env := range testCase.expEnv {
+					assert.Contains(container.Env, env, container.Name)
+				}
+				if testCase.expSecret != "" {
+					assert.Contains(container.VolumeMounts, authMount, container.Name)
+				} else {
+					assert.NotContains(container.VolumeMounts, authMount, container.Name)
+				}
+			}
+
+			if testCase.expSecret != "" {
+				assert.Contains(pod.Spec.Volumes, corev1.Volume{
+					Name: "vault-auth",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{SecretName: testCase.expSecret},
+					},
+				})
+			} else {
+				assert.False(hasVolume(pod.Spec.Volumes, "vault-auth"))
+			}
+		})
+	}
+}
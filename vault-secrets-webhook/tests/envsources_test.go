@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVaultEnvInjectionEnvSources(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared-env", Namespace: "default"},
+			Data: map[string]string{
+				"LOG_LEVEL":   "info",
+				"DB_PASSWORD": "vault:secret/data/db#password",
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "plain-env", Namespace: "default"},
+			Data:       map[string]string{"LOG_LEVEL": "debug"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Data:       map[string][]byte{"token": []byte("vault:secret/data/api#token")},
+		},
+	)
+	wh.SetKubernetesClient(client)
+	defer wh.SetKubernetesClient(nil)
+	wh.InitConfig()
+
+	optional := true
+	tests := []struct {
+		name    string
+		envFrom []corev1.EnvFromSource
+		env     []corev1.EnvVar
+		wrapped bool
+		expErr  bool
+	}{
+		{
+			name: "vault value in a ConfigMap consumed with envFrom",
+			envFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "shared-env"}}},
+			},
+			wrapped: true,
+		},
+		{
+			name: "vault value in a Secret consumed with valueFrom",
+			env: []corev1.EnvVar{
+				{
+					Name: "API_TOKEN",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "api"}, Key: "token"},
+					},
+				},
+			},
+			wrapped: true,
+		},
+		{
+			name: "vault value in a ConfigMap overridden by a literal env",
+			envFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "shared-env"}}},
+			},
+			env: []corev1.EnvVar{
+				{Name: "DB_PASSWORD", Value: "not-a-secret"},
+			},
+			wrapped: false,
+		},
+		{
+			name: "ConfigMaps without vault values and missing optional refs",
+			envFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "plain-env"}}},
+				{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Optional: &optional}},
+			},
+			wrapped: false,
+		},
+		{
+			name: "missing optional keys",
+			env: []corev1.EnvVar{
+				{
+					Name: "API_KEY",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "api"}, Key: "key", Optional: &optional},
+					},
+				},
+			},
+			wrapped: false,
+		},
+		{
+			name: "missing required ConfigMap consumed with envFrom",
+			envFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}}},
+			},
+			expErr: true,
+		},
+		{
+			name: "missing required Secret consumed with valueFrom",
+			env: []corev1.EnvVar{
+				{
+					Name: "API_TOKEN",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "token"},
+					},
+				},
+			},
+			expErr: true,
+		},
+		{
+			name: "missing required key",
+			env: []corev1.EnvVar{
+				{
+					Name: "LOG_FORMAT",
+					ValueFrom: &corev1.EnvVarSource{
+						ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "plain-env"}, Key: "LOG_FORMAT"},
+					},
+				},
+			},
+			expErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-pod-env-sources",
+					Namespace: "default",
+					Annotations: map[string]string{
+						"vault.security/enabled":               "true",
+						"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+						"vault.security/vault-role":            "some-role",
+						"vault.security/vault-tls-secret-name": "vault-consul-ca",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "alpine",
+							Image:   "alpine",
+							Command: []string{"user-command"},
+							EnvFrom: test.envFrom,
+							Env:     test.env,
+						},
+					},
+				},
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if test.expErr {
+				assert.Error(err)
+				return
+			}
+			if assert.NoError(err) {
+				if test.wrapped {
+					assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+					assert.Len(pod.Spec.InitContainers, 1)
+				} else {
+					assert.Equal([]string{"user-command"}, pod.Spec.Containers[0].Command)
+					assert.Empty(pod.Spec.InitContainers)
+				}
+			}
+		})
+	}
+}
+
+func TestVaultEnvInjectionEnvSourcesWorkload(t *testing.T) {
+	assert := assert.New(t)
+	wh.SetKubernetesClient(fake.NewSimpleClientset())
+	defer wh.SetKubernetesClient(nil)
+	wh.InitConfig()
+
+	// the ConfigMap and Secret may be applied after the Deployment
+	pod := newVaultPod("test-pod-env-sources", nil)
+	pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}}},
+	}
+	pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+		Name: "API_TOKEN",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "token"},
+		},
+	})
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: *pod.Spec.DeepCopy()},
+		},
+	}
+
+	_, err := wh.VaultSecretsMutator(context.TODO(), deployment)
+	if assert.NoError(err) {
+		assert.Equal([]string{"/vault/vault-env"}, deployment.Spec.Template.Spec.Containers[0].Command)
+	}
+
+	t.Log("Checking a pod with the same refs is rejected")
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	assert.Error(err)
+}
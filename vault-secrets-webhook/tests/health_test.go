@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/slok/kubewebhook/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// writeKeyPair writes a self-signed key pair valid until notAfter to dir
+func writeKeyPair(t *testing.T, dir string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vault-secrets-webhook"},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "servingCert"), filepath.Join(dir, "servingKey")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestReadyzHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := wh.HealthCheck{Name: "ok", Check: func() error { return nil }}
+	failing := wh.HealthCheck{Name: "failing", Check: func() error { return errors.New("boom") }}
+
+	rec := httptest.NewRecorder()
+	wh.ReadyzHandler(ok).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	wh.ReadyzHandler(ok, failing).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(rec.Body.String(), "[-] failing failed: boom")
+
+	t.Log("Checking the checks run in parallel")
+	slow := wh.HealthCheck{Name: "slow", Check: func() error {
+		time.Sleep(500 * time.Millisecond)
+		return nil
+	}}
+	start := time.Now()
+	rec = httptest.NewRecorder()
+	wh.ReadyzHandler(slow, slow, slow).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(time.Since(start) < time.Second, "checks took %s", time.Since(start))
+
+	rec = httptest.NewRecorder()
+	wh.HealthzHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+}
+
+func TestReadinessChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "vault-secrets-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Checking the TLS key pair check")
+	certFile, keyFile := writeKeyPair(t, dir, time.Now().Add(24*time.Hour))
+	watcher, err := wh.NewCertWatcher(certFile, keyFile, &log.Std{})
+	if assert.NoError(err) {
+		assert.NoError(wh.TLSKeyPairCheck(watcher).Check())
+	}
+	certFile, keyFile = writeKeyPair(t, dir, time.Now().Add(-time.Hour))
+	watcher, err = wh.NewCertWatcher(certFile, keyFile, &log.Std{})
+	if assert.NoError(err) {
+		assert.Error(wh.TLSKeyPairCheck(watcher).Check())
+	}
+
+	t.Log("Checking the kubernetes API check")
+	assert.NoError(wh.KubernetesAPICheck(nil).Check())
+	assert.NoError(wh.KubernetesAPICheck(fake.NewSimpleClientset()).Check())
+
+	t.Log("Checking the vault health check")
+	status := http.StatusOK
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/sys/health", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer vault.Close()
+
+	check, err := wh.VaultHealthCheck(vault.URL, "")
+	if assert.NoError(err) {
+		assert.NoError(check.Check())
+		status = http.StatusServiceUnavailable
+		assert.Error(check.Check())
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const injectManifests = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+      annotations:
+        vault.security/enabled: "true"
+        vault.security/vault-addr: https://vault.default.svc.cluster.local:8200
+        vault.security/vault-role: some-role
+        vault.security/vault-path: /secret/some/path
+        vault.security/vault-tls-secret-name: vault-consul-ca
+    spec:
+      containers:
+      - name: app
+        image: alpine
+        command: ["user-command"]
+        env:
+        - name: AWS_SECRET_ACCESS_KEY
+          value: vault:AWS_SECRET_ACCESS_KEY
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: broken
+    annotations:
+      vault.security/enabled: "true"
+  spec:
+    containers:
+    - name: app
+      image: alpine
+      command: ["user-command"]
+`
+
+func TestInject(t *testing.T) {
+	assert := assert.New(t)
+	wh.InitConfig()
+
+	var out bytes.Buffer
+	if !assert.NoError(wh.Inject(strings.NewReader(injectManifests), &out, "default", false)) {
+		return
+	}
+
+	docs := strings.Split(out.String(), "---\n")
+	if !assert.Len(docs, 3) {
+		return
+	}
+
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode([]byte(docs[0]), nil, nil)
+	if assert.NoError(err) {
+		deployment := obj.(*appsv1.Deployment)
+		assert.Equal([]string{"/vault/vault-env"}, deployment.Spec.Template.Spec.Containers[0].Command)
+		assert.Equal([]string{"user-command"}, deployment.Spec.Template.Spec.Containers[0].Args)
+		assert.Len(deployment.Spec.Template.Spec.InitContainers, 1)
+	}
+
+	t.Log("Checking unknown kinds and objects failing injection are passed through")
+	assert.Contains(docs[1], "kind: Widget")
+	obj, _, err = scheme.Codecs.UniversalDeserializer().Decode([]byte(docs[2]), nil, nil)
+	if assert.NoError(err) {
+		assert.IsType(&corev1.List{}, obj)
+		assert.NotContains(docs[2], "vault-env")
+	}
+
+	t.Log("Checking injection errors fail with fail-on-error")
+	err = wh.Inject(strings.NewReader(injectManifests), &bytes.Buffer{}, "default", true)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "Pod broken")
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const krmResourceList = `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: vault-secrets
+  data:
+    namespace: apps
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: app
+    annotations:
+      vault.security/enabled: "true"
+      vault.security/vault-addr: https://vault.default.svc.cluster.local:8200
+      vault.security/vault-role: some-role
+      vault.security/vault-path: /secret/some/path
+      vault.security/vault-tls-secret-name: vault-consul-ca
+  spec:
+    containers:
+    - name: app
+      image: alpine
+      command: ["user-command"]
+      env:
+      - name: AWS_SECRET_ACCESS_KEY
+        value: vault:AWS_SECRET_ACCESS_KEY
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: broken
+    namespace: other
+    annotations:
+      vault.security/enabled: "true"
+  spec:
+    containers:
+    - name: app
+      image: alpine
+      command: ["user-command"]
+- apiVersion: example.com/v1
+  kind: Widget
+  metadata:
+    name: widget
+`
+
+func TestKRMFunction(t *testing.T) {
+	assert := assert.New(t)
+	wh.InitConfig()
+
+	var out bytes.Buffer
+	failed, err := wh.RunKRMFunction(strings.NewReader(krmResourceList), &out)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(failed)
+
+	var list struct {
+		Kind    string
+		Items   []map[string]interface{}
+		Results []struct {
+			Message     string
+			Severity    string
+			ResourceRef map[string]string `json:"resourceRef"`
+		}
+	}
+	if !assert.NoError(yaml.Unmarshal(out.Bytes(), &list)) {
+		return
+	}
+	assert.Equal("ResourceList", list.Kind)
+	if !assert.Len(list.Items, 3) {
+		return
+	}
+
+	raw, _ := yaml.Marshal(list.Items[0])
+	var pod corev1.Pod
+	if assert.NoError(yaml.Unmarshal(raw, &pod)) {
+		assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+		assert.Len(pod.Spec.InitContainers, 1)
+	}
+	assert.Equal("Widget", list.Items[2]["kind"])
+
+	if assert.Len(list.Results, 2) {
+		assert.Equal("info", list.Results[0].Severity)
+		assert.Equal("app", list.Results[0].ResourceRef["name"])
+		assert.Equal("error", list.Results[1].Severity)
+		assert.Equal(map[string]string{"apiVersion": "v1", "kind": "Pod", "name": "broken", "namespace": "other"}, list.Results[1].ResourceRef)
+		assert.Contains(list.Results[1].Message, "vault address")
+	}
+}
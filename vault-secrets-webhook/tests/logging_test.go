@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRequestLogging(t *testing.T) {
+	assert := assert.New(t)
+
+	logger, err := wh.NewLogger("info", "json")
+	if !assert.NoError(err) {
+		return
+	}
+	var out bytes.Buffer
+	logger.SetOutput(&out)
+	wh.SetLogger(logger)
+	defer func() {
+		l, _ := wh.NewLogger("info", "text")
+		wh.SetLogger(l)
+	}()
+
+	_, err = wh.NewLogger("info", "xml")
+	assert.Error(err)
+
+	wh.InitConfig()
+	ctx := whcontext.SetAdmissionRequest(context.TODO(), &admissionv1beta1.AdmissionRequest{
+		UID:       "2a6b5a0e-1b2c-4d5e-8f90-123456789abc",
+		Namespace: "default",
+		Operation: admissionv1beta1.Create,
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "app-7d9f8c-",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+				},
+			},
+		},
+	}
+
+	_, err = wh.InstrumentMutator(wh.VaultSecretsMutator)(ctx, pod)
+	assert.Error(err)
+
+	var entry map[string]interface{}
+	if assert.NoError(json.Unmarshal(out.Bytes(), &entry), out.String()) {
+		assert.Equal("warning", entry["level"])
+		assert.Equal("2a6b5a0e-1b2c-4d5e-8f90-123456789abc", entry["uid"])
+		assert.Equal("default", entry["namespace"])
+		assert.Equal("app-7d9f8c-", entry["generateName"])
+		assert.Equal("CREATE", entry["operation"])
+		assert.Equal("rejected", entry["decision"])
+		assert.Equal("missing_vault_role", entry["reason"])
+		assert.NotEmpty(entry["duration"])
+	}
+}
+
+func TestVaultEnvLoggingConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	wh.InitConfig()
+	viper.Set("vault_env_log_format", "text")
+	viper.Set("vault_env_log_level", "debug")
+	defer func() {
+		viper.Set("vault_env_log_format", "")
+		viper.Set("vault_env_log_level", "")
+	}()
+
+	pod := newVaultPod("test-pod-with-vault-env-logging", nil)
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_ENV_LOG_FORMAT", Value: "text"})
+	assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_ENV_LOG_LEVEL", Value: "debug"})
+}
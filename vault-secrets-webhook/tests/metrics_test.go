@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// metricValue returns the value of the counter or the sample count of the histogram matching labels
+func metricValue(t *testing.T, gatherer prometheus.Gatherer, name string, labels map[string]string) float64 {
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			if metric.GetHistogram() != nil {
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestVaultEnvInjectionMetrics(t *testing.T) {
+	assert := assert.New(t)
+	registry := prometheus.NewRegistry()
+	if !assert.NoError(wh.RegisterMetrics(registry)) {
+		return
+	}
+
+	newPod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-pod-metrics",
+				Namespace:   "metrics",
+				Annotations: annotations,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:    "alpine",
+						Image:   "alpine",
+						Command: []string{"user-command"},
+						Env: []corev1.EnvVar{
+							{
+								Name:  "AWS_SECRET_ACCESS_KEY",
+								Value: "vault:AWS_SECRET_ACCESS_KEY",
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	wh.InitConfig()
+	mutator := wh.InstrumentMutator(wh.VaultSecretsMutator)
+
+	_, err := mutator(context.TODO(), newPod(map[string]string{
+		"vault.security/enabled":               "true",
+		"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+		"vault.security/vault-role":            "some-role",
+		"vault.security/vault-path":            "/secret/some/path",
+		"vault.security/vault-tls-secret-name": "vault-consul-ca",
+	}))
+	assert.NoError(err)
+
+	_, err = mutator(context.TODO(), newPod(nil))
+	assert.NoError(err)
+
+	_, err = mutator(context.TODO(), newPod(map[string]string{
+		"vault.security/enabled":               "true",
+		"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+		"vault.security/vault-tls-secret-name": "vault-consul-ca",
+	}))
+	assert.Error(err)
+
+	requests := "vault_secrets_webhook_admission_requests_total"
+	assert.Equal(1.0, metricValue(t, registry, requests, map[string]string{"result": "mutated", "reason": "", "namespace": "metrics"}))
+	assert.Equal(1.0, metricValue(t, registry, requests, map[string]string{"result": "skipped", "reason": "", "namespace": "metrics"}))
+	assert.Equal(1.0, metricValue(t, registry, requests, map[string]string{"result": "rejected", "reason": "missing_vault_role", "namespace": "metrics"}))
+
+	duration := "vault_secrets_webhook_mutation_duration_seconds"
+	assert.Equal(1.0, metricValue(t, registry, duration, map[string]string{"result": "mutated"}))
+	assert.Equal(1.0, metricValue(t, registry, duration, map[string]string{"result": "rejected"}))
+}
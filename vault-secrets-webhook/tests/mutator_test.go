@@ -6,7 +6,11 @@ import (
 
 	"github.com/go-test/deep"
 	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -134,12 +138,13 @@ func TestVaultEnvInjectionPodMutate(t *testing.T) {
 						"vault.security/vault-role":            "some-role",
 						"vault.security/vault-path":            "/secret/some/path",
 						"vault.security/vault-tls-secret-name": "vault-consul-ca",
+						"vault.security/status":                `{"version":"3","containers":["alpine"],"initContainers":["vault-init"],"volumes":["vault-env","vault-tls"]}`,
 					},
 				},
 				Spec: corev1.PodSpec{
 					InitContainers: []corev1.Container{
 						{
-							Name:            "init",
+							Name:            "vault-init",
 							Image:           "innovia/vault-env:1.1.0",
 							ImagePullPolicy: corev1.PullIfNotPresent,
 							Command:         []string{"sh", "-c", "cp /usr/local/bin/vault-env /vault/"},
@@ -180,7 +185,7 @@ func TestVaultEnvInjectionPodMutate(t *testing.T) {
 									Name:      "vault-env",
 									MountPath: "/vault",
 								}, {
-									Name:      "tls",
+									Name:      "vault-tls",
 									MountPath: "/etc/tls",
 								},
 							},
@@ -195,7 +200,7 @@ func TestVaultEnvInjectionPodMutate(t *testing.T) {
 								},
 							},
 						}, {
-							Name: "tls",
+							Name: "vault-tls",
 							VolumeSource: corev1.VolumeSource{
 								Secret: &corev1.SecretVolumeSource{
 									SecretName: "vault-consul-ca",
@@ -205,6 +210,39 @@ func TestVaultEnvInjectionPodMutate(t *testing.T) {
 					},
 				},
 			},
+		}, {
+			name: "Mutating should fail when vault:<key> is used without annotation vault.security/vault-path",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-pod-without-vault-path",
+					Namespace: "default",
+					Annotations: map[string]string{
+						"vault.security/enabled":               "true",
+						"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+						"vault.security/vault-role":            "some-role",
+						"vault.security/vault-tls-secret-name": "vault-consul-ca",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "alpine",
+							Image:   "alpine",
+							Command: []string{"user-command"},
+							Env: []corev1.EnvVar{
+								{
+									Name:  "DB_PASSWORD",
+									Value: "vault:secret/data/db#password",
+								}, {
+									Name:  "AWS_SECRET_ACCESS_KEY",
+									Value: "vault:AWS_SECRET_ACCESS_KEY",
+								},
+							},
+						},
+					},
+				},
+			},
+			expErr: true,
 		},
 	}
 
@@ -271,3 +309,717 @@ func TestVaultEnvInjectionPodMutate(t *testing.T) {
 		})
 	}
 }
+
+func TestVaultEnvInjectionWorkloadMutate(t *testing.T) {
+	annotations := map[string]string{
+		"vault.security/enabled":               "true",
+		"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+		"vault.security/vault-role":            "some-role",
+		"vault.security/vault-path":            "/secret/some/path",
+		"vault.security/vault-tls-secret-name": "vault-consul-ca",
+	}
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "AWS_SECRET_ACCESS_KEY",
+							Value: "vault:AWS_SECRET_ACCESS_KEY",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name string
+		obj  metav1.Object
+	}{
+		{
+			name: "Deployment pod template should be mutated",
+			obj:  &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}, Spec: appsv1.DeploymentSpec{Template: *template.DeepCopy()}},
+		}, {
+			name: "StatefulSet pod template should be mutated",
+			obj:  &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}, Spec: appsv1.StatefulSetSpec{Template: *template.DeepCopy()}},
+		}, {
+			name: "DaemonSet pod template should be mutated",
+			obj:  &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}, Spec: appsv1.DaemonSetSpec{Template: *template.DeepCopy()}},
+		}, {
+			name: "Job pod template should be mutated",
+			obj:  &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}, Spec: batchv1.JobSpec{Template: *template.DeepCopy()}},
+		}, {
+			name: "CronJob pod template should be mutated",
+			obj: &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}, Spec: batchv1beta1.CronJobSpec{
+				JobTemplate: batchv1beta1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: *template.DeepCopy()}},
+			}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			wh.InitConfig()
+			_, err := wh.VaultSecretsMutator(context.TODO(), testCase.obj)
+			if assert.NoError(err) {
+				var template corev1.PodTemplateSpec
+				switch v := testCase.obj.(type) {
+				case *appsv1.Deployment:
+					template = v.Spec.Template
+				case *appsv1.StatefulSet:
+					template = v.Spec.Template
+				case *appsv1.DaemonSet:
+					template = v.Spec.Template
+				case *batchv1.Job:
+					template = v.Spec.Template
+				case *batchv1beta1.CronJob:
+					template = v.Spec.JobTemplate.Spec.Template
+				}
+				podSpec := template.Spec
+				assert.Len(podSpec.InitContainers, 1)
+				assert.Len(podSpec.Volumes, 2)
+				assert.Equal([]string{"/vault/vault-env"}, podSpec.Containers[0].Command)
+				assert.Equal([]string{"user-command"}, podSpec.Containers[0].Args)
+
+				t.Log("Checking a second pass does not inject twice")
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Annotations: template.Annotations},
+					Spec:       *podSpec.DeepCopy(),
+				}
+				_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+				if assert.NoError(err) {
+					if diff := deep.Equal(pod.Spec, podSpec); diff != nil {
+						t.Errorf("Pod created from a mutated template was mutated again; Diff:%#v", diff)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestVaultEnvInjectionPerVariablePath(t *testing.T) {
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-with-per-variable-path",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "DB_PASSWORD",
+							Value: "vault:secret/data/db#password",
+						}, {
+							Name:  "API_TOKEN",
+							Value: "vault:secret/data/api#token",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+		assert.Len(pod.Spec.InitContainers, 1)
+	}
+}
+
+func TestVaultEnvInjectionSecretFiles(t *testing.T) {
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-with-secret-files",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+				"vault.security/file.tls.key":          "secret/data/tls#key",
+				"vault.security/file..pgpass":          "pgpass",
+				"vault.security/file-mount-path":       "/etc/app/secrets",
+				"vault.security/file-mode":             "0440",
+				"vault.security/file-owner":            "1000:1000",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+				}, {
+					Name:    "sidecar",
+					Image:   "alpine",
+					Command: []string{"sidecar-command"},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) && assert.Len(pod.Spec.InitContainers, 2) {
+		filesContainer := pod.Spec.InitContainers[1]
+		assert.Equal("vault-files", filesContainer.Name)
+		assert.Equal([]string{"/usr/local/bin/vault-env"}, filesContainer.Command)
+		assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_FILES", Value: ".pgpass=pgpass,tls.key=secret/data/tls#key"})
+		assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_FILES_MODE", Value: "0440"})
+		assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_FILES_OWNER", Value: "1000:1000"})
+		assert.Contains(filesContainer.VolumeMounts, corev1.VolumeMount{Name: "vault-env", MountPath: "/vault"})
+
+		for _, container := range pod.Spec.Containers {
+			assert.NotEqual([]string{"/vault/vault-env"}, container.Command)
+			assert.Empty(container.Env)
+			assert.Contains(container.VolumeMounts, corev1.VolumeMount{Name: "vault-env", MountPath: "/etc/app/secrets", SubPath: "secrets", ReadOnly: true})
+		}
+	}
+
+	pod.Annotations["vault.security/file.../etc/passwd"] = "key"
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	assert.Error(err)
+}
+
+func TestVaultEnvInjectionSecretFilesDefaultOwner(t *testing.T) {
+	assert := assert.New(t)
+	uid, gid, fsGroup := int64(1000), int64(3000), int64(2000)
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		podContext  *corev1.PodSecurityContext
+		context     *corev1.SecurityContext
+		expOwner    string
+		expMode     string
+	}{
+		{
+			name:     "root pod",
+			expOwner: "",
+			expMode:  "",
+		}, {
+			name:       "pod user and fsGroup",
+			podContext: &corev1.PodSecurityContext{RunAsUser: &uid, FSGroup: &fsGroup},
+			expOwner:   "1000:2000",
+			expMode:    "0440",
+		}, {
+			name:     "container user and group",
+			context:  &corev1.SecurityContext{RunAsUser: &uid, RunAsGroup: &gid},
+			expOwner: "1000:3000",
+			expMode:  "0440",
+		}, {
+			name:       "fsGroup only",
+			podContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+			expOwner:   ":2000",
+			expMode:    "0440",
+		}, {
+			name: "annotated owner and mode",
+			annotations: map[string]string{
+				"vault.security/file-owner": "10:20",
+				"vault.security/file-mode":  "0400",
+			},
+			podContext: &corev1.PodSecurityContext{RunAsUser: &uid, FSGroup: &fsGroup},
+			expOwner:   "10:20",
+			expMode:    "0400",
+		},
+	}
+
+	wh.InitConfig()
+	for _, testCase := range testCases {
+		annotations := map[string]string{"vault.security/file.tls.key": "secret/data/tls#key"}
+		for key, value := range testCase.annotations {
+			annotations[key] = value
+		}
+		pod := newVaultPod("test-pod-with-secret-files-owner", annotations)
+		pod.Spec.SecurityContext = testCase.podContext
+		pod.Spec.Containers[0].SecurityContext = testCase.context
+
+		_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+		if assert.NoError(err, testCase.name) && assert.Len(pod.Spec.InitContainers, 2, testCase.name) {
+			filesContainer := pod.Spec.InitContainers[1]
+			assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_FILES_OWNER", Value: testCase.expOwner}, testCase.name)
+			assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_FILES_MODE", Value: testCase.expMode}, testCase.name)
+		}
+	}
+}
+
+func TestVaultEnvInjectionSecretFilesWatch(t *testing.T) {
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-with-watched-secret-files",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+				"vault.security/file.tls.key":          "secret/data/tls#key",
+				"vault.security/watch-interval":        "1m",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+				}, {
+					Name:    "sidecar",
+					Image:   "alpine",
+					Command: []string{"sidecar-command"},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		refresher := pod.Spec.Containers[0]
+		assert.Equal([]string{"/vault/vault-env"}, refresher.Command)
+		assert.Contains(refresher.Env, corev1.EnvVar{Name: "VAULT_FILES", Value: "tls.key=secret/data/tls#key"})
+		assert.Contains(refresher.Env, corev1.EnvVar{Name: "VAULT_WATCH_INTERVAL", Value: "1m"})
+
+		sidecar := pod.Spec.Containers[1]
+		assert.Equal([]string{"sidecar-command"}, sidecar.Command)
+		assert.Empty(sidecar.Env)
+		assert.Contains(sidecar.VolumeMounts, corev1.VolumeMount{Name: "vault-env", MountPath: "/vault/secrets", SubPath: "secrets", ReadOnly: true})
+	}
+}
+
+func TestVaultEnvInjectionTemplates(t *testing.T) {
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-with-templates",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+				"vault.security/template.config.json":  `{"token": {{ .token | toJSON }}}`,
+				"vault.security/template-configmap":    "app-templates",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "DATABASE_URL",
+							Value: "vault-template:postgres://{{ .user }}:{{ .password }}@db:5432/app",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+		if assert.Len(pod.Spec.InitContainers, 2) {
+			filesContainer := pod.Spec.InitContainers[1]
+			assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_TEMPLATES", Value: `{"config.json":"{\"token\": {{ .token | toJSON }}}"}`})
+			assert.Contains(filesContainer.Env, corev1.EnvVar{Name: "VAULT_TEMPLATES_DIR", Value: "/vault/templates"})
+			assert.Contains(filesContainer.VolumeMounts, corev1.VolumeMount{Name: "vault-templates", MountPath: "/vault/templates", ReadOnly: true})
+		}
+		assert.Len(pod.Spec.Volumes, 3)
+	}
+
+	pod.Annotations["vault.security/template.broken"] = "{{ .user "
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	assert.Error(err)
+}
+
+func TestVaultEnvInjectionReinvocation(t *testing.T) {
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-reinvoked",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "AWS_SECRET_ACCESS_KEY",
+							Value: "vault:AWS_SECRET_ACCESS_KEY",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if !assert.NoError(err) {
+		return
+	}
+	mutated := pod.DeepCopy()
+
+	t.Log("Checking a reinvocation does not inject twice")
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		if diff := deep.Equal(pod, mutated); diff != nil {
+			t.Errorf("Reinvocation changed the mutated pod; Diff:%#v", diff)
+		}
+	}
+
+	t.Log("Checking a re-submitted spec with the original command is wrapped again without duplicates")
+	pod.Spec.Containers[0].Command = []string{"user-command"}
+	pod.Spec.Containers[0].Args = nil
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		if diff := deep.Equal(pod, mutated); diff != nil {
+			t.Errorf("Re-submitted spec was not reconciled; Diff:%#v", diff)
+		}
+	}
+}
+
+func TestVaultEnvInjectionPodFromInjectedTemplate(t *testing.T) {
+	assert := assert.New(t)
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"vault.security/enabled":               "true",
+					"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+					"vault.security/vault-path":            "secret/data/app",
+					"vault.security/vault-tls-secret-name": "vault-consul-ca",
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:    "alpine",
+						Image:   "alpine",
+						Command: []string{"user-command"},
+						Env: []corev1.EnvVar{
+							{
+								Name:  "AWS_SECRET_ACCESS_KEY",
+								Value: "vault:AWS_SECRET_ACCESS_KEY",
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	wh.InitConfig()
+	viper.Set("default_vault_role_template", "{{ .Name }}")
+	defer viper.Set("default_vault_role_template", "")
+
+	template := newPod("app")
+	_, err := wh.VaultSecretsMutator(context.TODO(), template)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Contains(template.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_ROLE", Value: "app"})
+
+	t.Log("Checking a pod created from the injected template is rendered again without duplicates")
+	pod := newPod("app-0")
+	for key, value := range template.Annotations {
+		pod.Annotations[key] = value
+	}
+	pod.Spec = *template.Spec.DeepCopy()
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_ROLE", Value: "app-0"})
+		assert.Len(pod.Spec.Containers[0].Env, len(template.Spec.Containers[0].Env))
+		assert.Equal(template.Spec.InitContainers, pod.Spec.InitContainers)
+		assert.Equal(template.Spec.Volumes, pod.Spec.Volumes)
+	}
+}
+
+func TestVaultEnvInjectionForgedStatus(t *testing.T) {
+	assert := assert.New(t)
+	pod := newVaultPod("test-pod-with-forged-status", map[string]string{
+		"vault.security/status": `{"version":"3","containers":["alpine"],"initContainers":["vault-init"],"volumes":["vault-env","vault-tls"]}`,
+	})
+	pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, []corev1.EnvVar{
+		{Name: "VAULT_ADDR", Value: "https://vault.attacker.example.com"},
+		{Name: "VAULT_ADDR_ALLOWLIST", Value: "https://vault.attacker.example.com"},
+		{Name: "VAULT_ROLE", Value: "admin"},
+		{Name: "VAULT_AUTH_PATH", Value: "auth/admin"},
+	}...)
+	pod.Spec.InitContainers = []corev1.Container{
+		{
+			Name:    "vault-init",
+			Image:   "attacker/vault-env",
+			Command: []string{"sh", "-c", "cp /usr/local/bin/vault-env /vault/"},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if !assert.NoError(err) {
+		return
+	}
+
+	env := pod.Spec.Containers[0].Env
+	assert.Contains(env, corev1.EnvVar{Name: "VAULT_ADDR", Value: "https://vault.default.svc.cluster.local:8200"})
+	assert.Contains(env, corev1.EnvVar{Name: "VAULT_ROLE", Value: "some-role"})
+	for _, e := range env {
+		assert.NotEqual("VAULT_ADDR_ALLOWLIST", e.Name)
+		assert.NotEqual("VAULT_AUTH_PATH", e.Name)
+		assert.NotEqual("admin", e.Value)
+		assert.NotContains(e.Value, "attacker")
+	}
+
+	// the init container of the pod isn't the one the webhook renders, so it is kept aside
+	if assert.Len(pod.Spec.InitContainers, 2) {
+		assert.Equal("vault-init-1", pod.Spec.InitContainers[0].Name)
+		assert.Equal("innovia/vault-env:1.1.0", pod.Spec.InitContainers[0].Image)
+	}
+}
+
+func TestVaultEnvInjectionLegacyNames(t *testing.T) {
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-with-legacy-names",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+				"vault.security/status":                `{"version":"1","containers":["alpine"],"initContainers":["init"],"volumes":["vault-env","tls"]}`,
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{
+					Name:    "init",
+					Image:   "innovia/vault-env:1.1.0",
+					Command: []string{"sh", "-c", "cp /usr/local/bin/vault-env /vault/"},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "vault-env", MountPath: "/vault"},
+					},
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"/vault/vault-env"},
+					Args:    []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{Name: "AWS_SECRET_ACCESS_KEY", Value: "vault:AWS_SECRET_ACCESS_KEY"},
+						{Name: "VAULT_CAPATH", Value: "/etc/tls/ca.pem"},
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "vault-env", MountPath: "/vault"},
+						{Name: "tls", MountPath: "/etc/tls"},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "vault-env", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}}},
+				{Name: "tls", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "vault-consul-ca"}}},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(pod.Spec.InitContainers, 1, "the legacy init container is already injected")
+	assert.Equal("init", pod.Spec.InitContainers[0].Name)
+	assert.False(hasVolume(pod.Spec.Volumes, "vault-tls"), "the legacy TLS volume is already injected")
+	assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+	assert.Equal([]string{"user-command"}, pod.Spec.Containers[0].Args)
+	assert.Equal(
+		`{"version":"3","containers":["alpine"],"initContainers":["init"],"volumes":["vault-env","tls"]}`,
+		pod.Annotations["vault.security/status"],
+	)
+
+	t.Log("Checking a reinvocation keeps the legacy names")
+	mutated := pod.DeepCopy()
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		if diff := deep.Equal(pod, mutated); diff != nil {
+			t.Errorf("Reinvocation changed the mutated pod; Diff:%#v", diff)
+		}
+	}
+}
+
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newVaultPod returns a pod in the default namespace with the annotations injection needs,
+// overridden by annotations, and one container reading a secret from the vault path
+func newVaultPod(name string, annotations map[string]string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{Name: "AWS_SECRET_ACCESS_KEY", Value: "vault:AWS_SECRET_ACCESS_KEY"},
+					},
+				},
+			},
+		},
+	}
+	for key, value := range annotations {
+		pod.Annotations[key] = value
+	}
+	return pod
+}
+
+func TestVaultEnvInjectionNameConflicts(t *testing.T) {
+	assert := assert.New(t)
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-pod-conflicts",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"vault.security/enabled":               "true",
+					"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+					"vault.security/vault-role":            "some-role",
+					"vault.security/vault-path":            "/secret/some/path",
+					"vault.security/vault-tls-secret-name": "vault-consul-ca",
+				},
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{
+						Name:  "vault-init",
+						Image: "some-image",
+					},
+				},
+				Containers: []corev1.Container{
+					{
+						Name:    "alpine",
+						Image:   "alpine",
+						Command: []string{"user-command"},
+						Env: []corev1.EnvVar{
+							{
+								Name:  "AWS_SECRET_ACCESS_KEY",
+								Value: "vault:AWS_SECRET_ACCESS_KEY",
+							},
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							{
+								Name:      "vault-env",
+								MountPath: "/data",
+							},
+						},
+					},
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "vault-env",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	wh.InitConfig()
+
+	t.Log("Checking taken names get a suffix")
+	pod := newPod()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.Len(pod.Spec.InitContainers, 2)
+		assert.Equal("vault-init-1", pod.Spec.InitContainers[0].Name)
+		assert.Equal("vault-env-1", pod.Spec.InitContainers[0].VolumeMounts[0].Name)
+		assert.Len(pod.Spec.Volumes, 3)
+		assert.Equal("vault-env-1", pod.Spec.Volumes[1].Name)
+		assert.Equal("vault-tls", pod.Spec.Volumes[2].Name)
+		assert.Equal(
+			`{"version":"3","containers":["alpine"],"initContainers":["vault-init-1"],"volumes":["vault-env-1","vault-tls"]}`,
+			pod.Annotations["vault.security/status"],
+		)
+
+		t.Log("Checking a reinvocation reuses the suffixed names")
+		mutated := pod.DeepCopy()
+		_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+		if assert.NoError(err) {
+			if diff := deep.Equal(pod, mutated); diff != nil {
+				t.Errorf("Reinvocation changed the mutated pod; Diff:%#v", diff)
+			}
+		}
+	}
+
+	t.Log("Checking a container mounting something else at the injected path is rejected")
+	pod = newPod()
+	pod.Spec.Containers[0].VolumeMounts[0].MountPath = "/vault"
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "already mounts volume vault-env at /vault")
+	}
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVaultEnvInjectionNamespaceDefaults(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "team-a",
+			Annotations: map[string]string{
+				"vault.security/vault-addr":            "https://vault.team-a.svc.cluster.local:8200",
+				"vault.security/vault-role":            "team-a",
+				"vault.security/vault-path":            "secret/data/team-a",
+				"vault.security/vault-tls-secret-name": "vault-ca",
+				"owner":                                "team-a",
+			},
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := wh.StartNamespaceInformer(client, stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-with-namespace-defaults",
+			Namespace: "team-a",
+			Annotations: map[string]string{
+				"vault.security/enabled":    "true",
+				"vault.security/vault-role": "app",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "AWS_SECRET_ACCESS_KEY",
+							Value: "vault:AWS_SECRET_ACCESS_KEY",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		env := pod.Spec.Containers[0].Env
+		assert.Contains(env, corev1.EnvVar{Name: "VAULT_ADDR", Value: "https://vault.team-a.svc.cluster.local:8200"})
+		assert.Contains(env, corev1.EnvVar{Name: "VAULT_PATH", Value: "secret/data/team-a"})
+		assert.Contains(env, corev1.EnvVar{Name: "VAULT_ROLE", Value: "app"}, "pod annotations take precedence")
+		assert.Equal("vault-ca", pod.Spec.Volumes[1].Secret.SecretName)
+		assert.NotContains(pod.Annotations, "owner")
+	}
+}
+
+func TestVaultEnvInjectionNamespaceDefaultsOnly(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "team-c",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.team-c.svc.cluster.local:8200",
+				"vault.security/vault-role":            "team-c",
+				"vault.security/vault-tls-secret-name": "vault-ca",
+				"vault.security/file.password":         "secret/data/team-c#password",
+			},
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := wh.StartNamespaceInformer(client, stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	assert := assert.New(t)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-in-enabled-namespace",
+			Namespace: "team-c",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "alpine",
+					Image:   "alpine",
+					Command: []string{"user-command"},
+				},
+			},
+		},
+	}
+
+	wh.InitConfig()
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.Empty(pod.Spec.InitContainers, "namespace annotations must not enable injection")
+		assert.Empty(pod.Spec.Volumes)
+	}
+
+	pod.Annotations = map[string]string{"vault.security/enabled": "true"}
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.Empty(pod.Spec.InitContainers, "namespace annotations must not add secret files")
+	}
+}
@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testPolicy = `rules:
+- namespaces: ["team-*"]
+  roles: ["<namespace>-*"]
+  paths: ["secret/data/<namespace>/*"]
+- namespaces: ["team-x"]
+  serviceAccounts: ["deployer"]
+  roles: ["deployer"]
+  paths: ["secret/data/shared/*"]
+- namespaces: ["ops"]
+  roles: ["ops.app-?"]
+  paths: ["secret/data/ops/**/config"]
+`
+
+func TestVaultEnvInjectionPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(file, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := wh.LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh.SetPolicy(policy)
+	defer wh.SetPolicy(nil)
+
+	registry := prometheus.NewRegistry()
+	if err := wh.RegisterMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	wh.InitConfig()
+	mutator := wh.InstrumentMutator(wh.VaultSecretsMutator)
+
+	tests := []struct {
+		name           string
+		namespace      string
+		serviceAccount string
+		annotations    map[string]string
+		env            string
+		allowed        bool
+		// allowedPaths are passed to vault-env, which reads no other paths
+		allowedPaths string
+	}{
+		{
+			name:      "role and paths of the namespace",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role":     "team-x-app",
+				"vault.security/vault-path":     "/secret/data/team-x/app",
+				"vault.security/file.token":     "secret/data/team-x/api#token",
+				"vault.security/template.creds": `{{ with secret "secret/data/team-x/db" }}{{ .password }}{{ end }}`,
+			},
+			env:          "vault:secret/data/team-x/db#password",
+			allowed:      true,
+			allowedPaths: "secret/data/team-x/api,secret/data/team-x/app,secret/data/team-x/db",
+		},
+		{
+			name:      "role of another namespace",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-y-app",
+				"vault.security/vault-path": "secret/data/team-x/app",
+			},
+			env: "vault:password",
+		},
+		{
+			name:      "env path of another namespace",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-x-app",
+			},
+			env: "vault:secret/data/team-y/db#password",
+		},
+		{
+			name:      "secret file path of another namespace",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-x-app",
+				"vault.security/file.token": "secret/data/team-y/api#token",
+			},
+		},
+		{
+			name:      "template reading a path of another namespace",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role":     "team-x-app",
+				"vault.security/template.creds": `{{ (secret "secret/data/team-y/db").password }}`,
+			},
+		},
+		{
+			name:      "template reading a path that can't be checked",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role":     "team-x-app",
+				"vault.security/template.creds": `{{ with secret .path }}{{ .password }}{{ end }}`,
+			},
+		},
+		{
+			name:           "service account specific rule",
+			namespace:      "team-x",
+			serviceAccount: "deployer",
+			annotations: map[string]string{
+				"vault.security/vault-role": "deployer",
+			},
+			env:     "vault:secret/data/shared/registry#password",
+			allowed: true,
+		},
+		{
+			name:      "service account specific rule used by another service account",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "deployer",
+			},
+			env: "vault:secret/data/shared/registry#password",
+		},
+		{
+			name:      "single character and repeated star wildcards",
+			namespace: "ops",
+			annotations: map[string]string{
+				"vault.security/vault-role": "ops.app-1",
+			},
+			env:     "vault:secret/data/ops/eu/west/config#password",
+			allowed: true,
+		},
+		{
+			name:      "literal dot in a pattern",
+			namespace: "ops",
+			annotations: map[string]string{
+				"vault.security/vault-role": "opsxapp-1",
+			},
+			env: "vault:secret/data/ops/eu/config#password",
+		},
+		{
+			name:      "star wildcard crossing a path segment",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-x-app",
+			},
+			env: "vault:secret/data/team-x/app/db#password",
+		},
+		{
+			name:      "path escaping the namespace with a .. segment",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-x-app",
+			},
+			env: "vault:secret/data/team-x/../team-y/app#password",
+		},
+		{
+			name:      "path with a . segment",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-x-app",
+				"vault.security/vault-path": "secret/data/team-x/./app",
+			},
+			env: "vault:password",
+		},
+		{
+			name:      "path with an empty segment",
+			namespace: "team-x",
+			annotations: map[string]string{
+				"vault.security/vault-role": "team-x-app",
+				"vault.security/file.token": "secret/data/team-x//api#token",
+			},
+		},
+		{
+			name:      "namespace without a rule",
+			namespace: "kube-system",
+			annotations: map[string]string{
+				"vault.security/vault-role": "kube-system-app",
+			},
+			env: "vault:secret/data/kube-system/app#password",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			// the role and paths come from the test case only
+			pod := newVaultPod("test-pod-with-policy", nil)
+			delete(pod.Annotations, "vault.security/vault-role")
+			delete(pod.Annotations, "vault.security/vault-path")
+			for key, value := range test.annotations {
+				pod.Annotations[key] = value
+			}
+			pod.Namespace = test.namespace
+			pod.Spec.ServiceAccountName = test.serviceAccount
+			pod.Spec.Containers[0].Env = nil
+			if test.env != "" {
+				pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "SECRET", Value: test.env}}
+			}
+
+			denied := map[string]string{"result": "rejected", "reason": "policy_denied", "namespace": test.namespace}
+			deniedBefore := metricValue(t, registry, "vault_secrets_webhook_admission_requests_total", denied)
+
+			_, err := mutator(context.TODO(), pod)
+			if test.allowed {
+				if assert.NoError(err) {
+					assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+					if test.allowedPaths != "" {
+						assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_ALLOWED_PATHS", Value: test.allowedPaths})
+					}
+				}
+			} else {
+				assert.Error(err)
+				assert.Equal(deniedBefore+1, metricValue(t, registry, "vault_secrets_webhook_admission_requests_total", denied))
+			}
+		})
+	}
+}
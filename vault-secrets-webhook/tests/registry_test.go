@@ -0,0 +1,291 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestRegistry serves one image behind a manifest list and bearer token auth
+func newTestRegistry(t *testing.T, username string, password string) (*httptest.Server, *int) {
+	requests := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "repository:team/app:pull", r.URL.Query().Get("scope"))
+		json.NewEncoder(w).Encode(map[string]string{"token": "secret-token"})
+	})
+
+	mux.HandleFunc("/v2/team/app/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch strings.TrimPrefix(r.URL.Path, "/v2/team/app/") {
+		case "manifests/1.0":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+			fmt.Fprint(w, `{"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json", "manifests": [
+				{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm64"}},
+				{"digest": "sha256:amd", "platform": {"os": "linux", "architecture": "amd64"}}
+			]}`)
+		case "manifests/sha256:arm":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprint(w, `{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "config": {"digest": "sha256:armconfig"}}`)
+		case "blobs/sha256:armconfig":
+			fmt.Fprint(w, `{"config": {"Entrypoint": ["/docker-entrypoint-arm.sh"], "Cmd": ["app", "serve"]}}`)
+		case "manifests/sha256:amd":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprint(w, `{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "config": {"digest": "sha256:config"}}`)
+		case "blobs/sha256:config":
+			fmt.Fprint(w, `{"config": {"Entrypoint": ["/docker-entrypoint.sh"], "Cmd": ["app", "serve"]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	return server, &requests
+}
+
+func TestVaultEnvInjectionImageEntrypoint(t *testing.T) {
+	server, requests := newTestRegistry(t, "user", "pass")
+	defer server.Close()
+	registryHost := strings.TrimPrefix(server.URL, "http://")
+
+	dockerConfig, _ := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registryHost: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte("user:pass")),
+			},
+		},
+	})
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry-cred", Namespace: "default"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig},
+	})
+
+	testCases := []struct {
+		name    string
+		args    []string
+		expArgs []string
+	}{
+		{
+			name:    "Image ENTRYPOINT and CMD should be used when command and args are not set",
+			expArgs: []string{"/docker-entrypoint.sh", "app", "serve"},
+		}, {
+			name:    "Image ENTRYPOINT should be used with the container args when command is not set",
+			args:    []string{"migrate"},
+			expArgs: []string{"/docker-entrypoint.sh", "migrate"},
+		},
+	}
+
+	wh.InitConfig()
+	registry := wh.NewImageRegistry(5*time.Second, time.Hour)
+	registry.InsecureRegistries = []string{registryHost}
+	wh.SetImageRegistry(registry)
+	wh.SetKubernetesClient(client)
+	defer wh.SetKubernetesClient(nil)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-pod-without-command",
+					Namespace: "default",
+					Annotations: map[string]string{
+						"vault.security/enabled":               "true",
+						"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+						"vault.security/vault-role":            "some-role",
+						"vault.security/vault-path":            "/secret/some/path",
+						"vault.security/vault-tls-secret-name": "vault-consul-ca",
+					},
+				},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry-cred"}},
+					Containers: []corev1.Container{
+						{
+							Name:  "app",
+							Image: registryHost + "/team/app:1.0",
+							Args:  testCase.args,
+							Env: []corev1.EnvVar{
+								{
+									Name:  "AWS_SECRET_ACCESS_KEY",
+									Value: "vault:AWS_SECRET_ACCESS_KEY",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if assert.NoError(err) {
+				assert.Equal([]string{"/vault/vault-env"}, pod.Spec.Containers[0].Command)
+				assert.Equal(testCase.expArgs, pod.Spec.Containers[0].Args)
+			}
+		})
+	}
+
+	// the second lookup must be served from the cache
+	assert.Equal(t, 4, *requests)
+}
+
+func TestVaultEnvInjectionImageEntrypointUnauthorized(t *testing.T) {
+	server, _ := newTestRegistry(t, "user", "pass")
+	defer server.Close()
+
+	wh.InitConfig()
+	registry := wh.NewImageRegistry(5*time.Second, time.Hour)
+	registry.InsecureRegistries = []string{strings.TrimPrefix(server.URL, "http://")}
+	wh.SetImageRegistry(registry)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod-without-pull-secret",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"vault.security/enabled":               "true",
+				"vault.security/vault-addr":            "https://vault.default.svc.cluster.local:8200",
+				"vault.security/vault-role":            "some-role",
+				"vault.security/vault-path":            "/secret/some/path",
+				"vault.security/vault-tls-secret-name": "vault-consul-ca",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "app",
+					Image: strings.TrimPrefix(server.URL, "http://") + "/team/app:1.0",
+					Env: []corev1.EnvVar{
+						{
+							Name:  "AWS_SECRET_ACCESS_KEY",
+							Value: "vault:AWS_SECRET_ACCESS_KEY",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	assert.Error(t, err)
+}
+
+func TestVaultEnvInjectionImageEntrypointTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	wh.InitConfig()
+	viper.Set("registry_timeout", "100ms")
+	defer viper.Set("registry_timeout", "10s")
+	registry := wh.NewImageRegistry(time.Minute, time.Hour)
+	registry.InsecureRegistries = []string{strings.TrimPrefix(server.URL, "http://")}
+	wh.SetImageRegistry(registry)
+
+	newPod := func() *corev1.Pod {
+		pod := newVaultPod("test-pod-with-slow-registry", nil)
+		pod.Spec.Containers[0].Command = nil
+		pod.Spec.Containers[0].Image = strings.TrimPrefix(server.URL, "http://") + "/team/app:1.0"
+		return pod
+	}
+
+	start := time.Now()
+	_, err := wh.VaultSecretsMutator(context.TODO(), newPod())
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "the lookup should stop after registry_timeout")
+
+	t.Log("Checking the lookup stops with the admission request")
+	viper.Set("registry_timeout", "10s")
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	start = time.Now()
+	_, err = wh.VaultSecretsMutator(ctx, newPod())
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "the lookup should stop with the admission context")
+}
+
+func TestImageRegistryPlatform(t *testing.T) {
+	server, _ := newTestRegistry(t, "user", "pass")
+	defer server.Close()
+	registryHost := strings.TrimPrefix(server.URL, "http://")
+	auths := map[string]wh.RegistryAuth{registryHost: {Username: "user", Password: "pass"}}
+
+	testCases := []struct {
+		name          string
+		platform      string
+		expEntrypoint []string
+	}{
+		{
+			name:          "The default platform should be linux/amd64",
+			expEntrypoint: []string{"/docker-entrypoint.sh"},
+		}, {
+			name:          "The configured platform should be resolved from manifest lists",
+			platform:      "linux/arm64",
+			expEntrypoint: []string{"/docker-entrypoint-arm.sh"},
+		}, {
+			name:          "Unknown platforms should fall back to the first manifest",
+			platform:      "windows/amd64",
+			expEntrypoint: []string{"/docker-entrypoint-arm.sh"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			registry := wh.NewImageRegistry(5*time.Second, time.Hour)
+			registry.InsecureRegistries = []string{registryHost}
+			if testCase.platform != "" {
+				registry.Platform = testCase.platform
+			}
+
+			config, err := registry.GetImageConfig(context.TODO(), registryHost+"/team/app:1.0", auths, "default")
+			if assert.NoError(t, err) {
+				assert.Equal(t, testCase.expEntrypoint, config.Entrypoint)
+			}
+		})
+	}
+}
+
+func TestImageRegistryInsecureHosts(t *testing.T) {
+	server, _ := newTestRegistry(t, "user", "pass")
+	defer server.Close()
+	registryHost := strings.TrimPrefix(server.URL, "http://")
+	auths := map[string]wh.RegistryAuth{registryHost: {Username: "user", Password: "pass"}}
+
+	// registries not listed as insecure are talked to with https
+	registry := wh.NewImageRegistry(5*time.Second, time.Hour)
+	registry.InsecureRegistries = []string{"localhost:5000"}
+	_, err := registry.GetImageConfig(context.TODO(), registryHost+"/team/app:1.0", auths, "default")
+	assert.Error(t, err)
+
+	registry.InsecureRegistries = append(registry.InsecureRegistries, "http://"+registryHost)
+	_, err = registry.GetImageConfig(context.TODO(), registryHost+"/team/app:1.0", auths, "default")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/slok/kubewebhook/pkg/log"
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSelfManagedCerts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "vault-secrets-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := fake.NewSimpleClientset(&admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-secrets-webhook"},
+		Webhooks: []admissionregistrationv1beta1.Webhook{
+			{Name: "pods.vault-secrets-webhook.admission"},
+			{Name: "deployments.vault-secrets-webhook.admission"},
+		},
+	})
+	config := wh.SelfManagedCertsConfig{
+		Namespace:         "vault-infra",
+		SecretName:        "vault-secrets-webhook-certs",
+		ServiceName:       "vault-secrets-webhook",
+		WebhookConfigName: "vault-secrets-webhook",
+		CertFile:          filepath.Join(dir, "serving-cert", "servingCert"),
+		KeyFile:           filepath.Join(dir, "serving-cert", "servingKey"),
+		Validity:          24 * time.Hour,
+		RenewBefore:       time.Hour,
+	}
+
+	t.Log("Checking certificates are created on first start")
+	if !assert.NoError(wh.NewSelfManagedCerts(client, config, &log.Std{}).Ensure()) {
+		return
+	}
+	secret, err := client.CoreV1().Secrets("vault-infra").Get("vault-secrets-webhook-certs", metav1.GetOptions{})
+	if !assert.NoError(err) {
+		return
+	}
+
+	ca := x509.NewCertPool()
+	assert.True(ca.AppendCertsFromPEM(secret.Data["caCert"]))
+	servingCert, err := ioutil.ReadFile(config.CertFile)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(secret.Data["servingCert"], servingCert)
+	block, _ := pem.Decode(servingCert)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if assert.NoError(err) {
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: "vault-secrets-webhook.vault-infra.svc", Roots: ca})
+		assert.NoError(err)
+	}
+
+	webhookConfig, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get("vault-secrets-webhook", metav1.GetOptions{})
+	if assert.NoError(err) {
+		for _, webhook := range webhookConfig.Webhooks {
+			assert.Equal(secret.Data["caCert"], webhook.ClientConfig.CABundle)
+		}
+	}
+
+	t.Log("Checking another replica reuses the certificates")
+	if assert.NoError(wh.NewSelfManagedCerts(client, config, &log.Std{}).Ensure()) {
+		reused, err := client.CoreV1().Secrets("vault-infra").Get("vault-secrets-webhook-certs", metav1.GetOptions{})
+		if assert.NoError(err) {
+			assert.Equal(secret.Data, reused.Data)
+		}
+	}
+
+	t.Log("Checking certificates about to expire are re-issued")
+	config.RenewBefore = 50 * time.Hour
+	config.Validity = 72 * time.Hour
+	if assert.NoError(wh.NewSelfManagedCerts(client, config, &log.Std{}).Ensure()) {
+		renewed, err := client.CoreV1().Secrets("vault-infra").Get("vault-secrets-webhook-certs", metav1.GetOptions{})
+		if assert.NoError(err) {
+			assert.NotEqual(secret.Data["servingCert"], renewed.Data["servingCert"])
+			// the CA was valid for 48h so it was rotated too, the old one stays trusted
+			assert.Len(pemCertificates(renewed.Data["caCert"]), 2)
+
+			servingCert, err := ioutil.ReadFile(config.CertFile)
+			if assert.NoError(err) {
+				assert.Equal(renewed.Data["servingCert"], servingCert)
+			}
+		}
+	}
+}
+
+func TestSelfManagedCertsReplicas(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "vault-secrets-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := fake.NewSimpleClientset(&admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-secrets-webhook"},
+		Webhooks:   []admissionregistrationv1beta1.Webhook{{Name: "pods.vault-secrets-webhook.admission"}},
+	})
+	conflicts := 0
+	client.PrependReactor("update", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "mutatingwebhookconfigurations"}, "vault-secrets-webhook", nil)
+		}
+		return false, nil, nil
+	})
+
+	newConfig := func(replica string) wh.SelfManagedCertsConfig {
+		return wh.SelfManagedCertsConfig{
+			Namespace:         "vault-infra",
+			SecretName:        "vault-secrets-webhook-certs",
+			ServiceName:       "vault-secrets-webhook",
+			WebhookConfigName: "vault-secrets-webhook",
+			CertFile:          filepath.Join(dir, replica, "servingCert"),
+			KeyFile:           filepath.Join(dir, replica, "servingKey"),
+			Validity:          24 * time.Hour,
+			RenewBefore:       time.Hour,
+		}
+	}
+
+	t.Log("Checking a conflicting caBundle update is retried")
+	a := newConfig("a")
+	if !assert.NoError(wh.NewSelfManagedCerts(client, a, &log.Std{}).Ensure()) {
+		return
+	}
+	assert.Equal(1, conflicts)
+	webhookConfig, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get("vault-secrets-webhook", metav1.GetOptions{})
+	if assert.NoError(err) {
+		assert.NotEmpty(webhookConfig.Webhooks[0].ClientConfig.CABundle)
+	}
+
+	t.Log("Checking another replica serves certificates re-issued by the first one without waiting for its interval")
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	b := newConfig("b")
+	go wh.NewSelfManagedCerts(client, b, &log.Std{}).Run(time.Hour, stopCh)
+
+	a.RenewBefore = 50 * time.Hour
+	a.Validity = 72 * time.Hour
+	if !assert.NoError(wh.NewSelfManagedCerts(client, a, &log.Std{}).Ensure()) {
+		return
+	}
+	renewed, err := ioutil.ReadFile(a.CertFile)
+	if !assert.NoError(err) {
+		return
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if servingCert, err := ioutil.ReadFile(b.CertFile); err == nil && bytes.Equal(renewed, servingCert) {
+			return
+		}
+	}
+	t.Error("expected the other replica to write the re-issued serving certificate")
+}
+
+func pemCertificates(data []byte) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block)
+	}
+}
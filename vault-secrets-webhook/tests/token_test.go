@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVaultEnvInjectionServiceAccountToken(t *testing.T) {
+	automount := false
+	expiration := int64(3600)
+	defaultExpiration := int64(600)
+	defaultVolume := &corev1.Volume{
+		Name: "vault-token",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          "vault",
+							ExpirationSeconds: &defaultExpiration,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		automount   *bool
+		expVolume   *corev1.Volume
+		expErr      bool
+	}{
+		{
+			name: "Token should be projected with the annotated audience and expiration",
+			annotations: map[string]string{
+				"vault.security/service-account-token-projection": "true",
+				"vault.security/service-account-token-audience":   "https://vault.example.com",
+				"vault.security/service-account-token-expiration": "1h",
+			},
+			expVolume: &corev1.Volume{
+				Name: "vault-token",
+				VolumeSource: corev1.VolumeSource{
+					Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{
+							{
+								ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+									Audience:          "https://vault.example.com",
+									ExpirationSeconds: &expiration,
+									Path:              "token",
+								},
+							},
+						},
+					},
+				},
+			},
+		}, {
+			name: "Token should not be projected by default",
+		}, {
+			name:      "Token should be projected when the pod doesn't automount one",
+			automount: &automount,
+			expVolume: defaultVolume,
+		}, {
+			name:        "Token should be projected when the pod doesn't automount one even if disabled",
+			annotations: map[string]string{"vault.security/service-account-token-projection": "false"},
+			automount:   &automount,
+			expVolume:   defaultVolume,
+		}, {
+			name:        "Token should not be projected when disabled",
+			annotations: map[string]string{"vault.security/service-account-token-projection": "false"},
+		}, {
+			name: "Token should not be projected for auth methods without a service account token",
+			annotations: map[string]string{
+				"vault.security/service-account-token-projection": "true",
+				"vault.security/vault-auth-method":                "approle",
+				"vault.security/vault-role-id-file":               "/etc/approle/role-id",
+				"vault.security/vault-secret-id-file":             "/etc/approle/secret-id",
+			},
+		}, {
+			name: "Expirations the API server doesn't issue should be rejected",
+			annotations: map[string]string{
+				"vault.security/service-account-token-projection": "true",
+				"vault.security/service-account-token-expiration": "5m",
+			},
+			expErr: true,
+		},
+	}
+
+	wh.InitConfig()
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := newVaultPod("test-pod-with-token", testCase.annotations)
+			pod.Spec.AutomountServiceAccountToken = testCase.automount
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.expErr {
+				assert.Error(err)
+				return
+			}
+			if !assert.NoError(err) {
+				return
+			}
+
+			container := pod.Spec.Containers[0]
+			tokenEnv := corev1.EnvVar{Name: "VAULT_SA_TOKEN_FILE", Value: "/var/run/secrets/vault/token"}
+			tokenMount := corev1.VolumeMount{Name: "vault-token", MountPath: "/var/run/secrets/vault", ReadOnly: true}
+			if testCase.expVolume != nil {
+				assert.Contains(pod.Spec.Volumes, *testCase.expVolume)
+				assert.Contains(container.Env, tokenEnv)
+				assert.Contains(container.VolumeMounts, tokenMount)
+			} else {
+				assert.Len(pod.Spec.Volumes, 2)
+				assert.NotContains(container.Env, tokenEnv)
+				assert.NotContains(container.VolumeMounts, tokenMount)
+			}
+		})
+	}
+}
+
+func TestVaultEnvInjectionServiceAccountWithoutAutomount(t *testing.T) {
+	assert := assert.New(t)
+	automount := false
+	wh.SetKubernetesClient(fake.NewSimpleClientset(&corev1.ServiceAccount{
+		ObjectMeta:                   metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		AutomountServiceAccountToken: &automount,
+	}))
+	defer wh.SetKubernetesClient(nil)
+	wh.InitConfig()
+
+	pod := newVaultPod("test-pod-with-token", nil)
+	pod.Spec.ServiceAccountName = "app"
+	_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.True(hasVolume(pod.Spec.Volumes, "vault-token"))
+		assert.Contains(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "VAULT_SA_TOKEN_FILE", Value: "/var/run/secrets/vault/token"})
+	}
+
+	t.Log("Checking the automount setting of the pod takes precedence")
+	automountPod := true
+	pod = newVaultPod("test-pod-with-token", nil)
+	pod.Spec.ServiceAccountName = "app"
+	pod.Spec.AutomountServiceAccountToken = &automountPod
+	_, err = wh.VaultSecretsMutator(context.TODO(), pod)
+	if assert.NoError(err) {
+		assert.False(hasVolume(pod.Spec.Volumes, "vault-token"))
+	}
+}
@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVaultEnvInjectionVaultNamespace(t *testing.T) {
+	testCases := []struct {
+		name             string
+		annotations      map[string]string
+		defaultNamespace string
+		expNamespace     string
+		expErr           bool
+	}{
+		{
+			name:         "Annotated namespace should be passed to vault-env",
+			annotations:  map[string]string{"vault.security/vault-namespace": "org/team-a"},
+			expNamespace: "org/team-a",
+		}, {
+			name:             "Webhook default should apply without an annotation",
+			defaultNamespace: "org",
+			expNamespace:     "org",
+		}, {
+			name:             "Annotation should override the webhook default",
+			annotations:      map[string]string{"vault.security/vault-namespace": "team-b"},
+			defaultNamespace: "org",
+			expNamespace:     "team-b",
+		}, {
+			name: "No namespace should be set by default",
+		}, {
+			name:        "Invalid namespaces should be rejected",
+			annotations: map[string]string{"vault.security/vault-namespace": "org/../team-a"},
+			expErr:      true,
+		},
+	}
+
+	wh.InitConfig()
+	defer viper.Set("default_vault_namespace", "")
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			viper.Set("default_vault_namespace", testCase.defaultNamespace)
+
+			pod := newVaultPod("test-pod-with-vault-namespace", testCase.annotations)
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.expErr {
+				assert.Error(err)
+				return
+			}
+			if !assert.NoError(err) {
+				return
+			}
+
+			var namespaceEnv *corev1.EnvVar
+			for i, env := range pod.Spec.Containers[0].Env {
+				if env.Name == "VAULT_NAMESPACE" {
+					namespaceEnv = &pod.Spec.Containers[0].Env[i]
+				}
+			}
+			if testCase.expNamespace == "" {
+				assert.Nil(namespaceEnv)
+			} else if assert.NotNil(namespaceEnv) {
+				assert.Equal(testCase.expNamespace, namespaceEnv.Value)
+			}
+		})
+	}
+}
+
+func TestVaultEnvInjectionVaultNamespacePolicy(t *testing.T) {
+	wh.SetPolicy(&wh.Policy{Rules: []wh.PolicyRule{
+		{
+			Namespaces: []string{"team-z"},
+			Paths: []string{
+				"secret/data/team-z/*", "shared/secret/data/common/*",
+				"org/secret/data/team-z/*", "org/shared/secret/data/common/*",
+				"org/team-z/*",
+			},
+		},
+	}})
+	defer wh.SetPolicy(nil)
+	wh.InitConfig()
+	defer viper.Set("default_vault_namespace", "")
+
+	testCases := []struct {
+		name             string
+		env              string
+		vaultNamespace   string
+		defaultNamespace string
+		allowed          bool
+	}{
+		{
+			name:    "References in the pod namespace should match the plain path",
+			env:     "vault:secret/data/team-z/app#password",
+			allowed: true,
+		}, {
+			name:    "Cross-namespace references should match the namespace qualified path",
+			env:     "vault:secret/data/common/db#password?namespace=shared",
+			allowed: true,
+		}, {
+			name: "Cross-namespace references should not match the plain path",
+			env:  "vault:secret/data/team-z/app#password?namespace=other",
+		}, {
+			name: "Keys of the default path in another namespace should be checked too",
+			env:  "vault:password?namespace=shared",
+		}, {
+			name:           "Paths should be prefixed with the Vault namespace of the pod",
+			env:            "vault:secret/data/team-z/app#password",
+			vaultNamespace: "org",
+			allowed:        true,
+		}, {
+			name:           "Reference namespaces should be joined onto the Vault namespace of the pod",
+			env:            "vault:secret/data/common/db#password?namespace=shared",
+			vaultNamespace: "org",
+			allowed:        true,
+		}, {
+			name:           "Paths allowed in the root namespace should be denied in another Vault namespace",
+			env:            "vault:secret/data/team-z/app#password",
+			vaultNamespace: "other",
+		}, {
+			name:             "Paths should be prefixed with the webhook default Vault namespace",
+			env:              "vault:secret/data/team-z/app#password",
+			defaultNamespace: "other",
+		}, {
+			name:           "Reference namespaces escaping the Vault namespace of the pod should be rejected",
+			env:            "vault:secret/data/common/db#password?namespace=../org/shared",
+			vaultNamespace: "org/team-z",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			pod := newVaultPod("test-pod-with-cross-namespace-reference", map[string]string{
+				"vault.security/vault-path":             "secret/data/team-z/app",
+				"vault.security/vault-auth-method":      "approle",
+				"vault.security/vault-auth-secret-name": "vault-approle",
+			})
+			pod.Namespace = "team-z"
+			delete(pod.Annotations, "vault.security/vault-role")
+			pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "SECRET", Value: testCase.env}}
+			if testCase.vaultNamespace != "" {
+				pod.Annotations["vault.security/vault-namespace"] = testCase.vaultNamespace
+			}
+			viper.Set("default_vault_namespace", testCase.defaultNamespace)
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	wh "github.com/innovia/vault-secrets-webhook/webhookmain"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestVaultEnvInjectionWatchConfig(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expEnv      []corev1.EnvVar
+		expErr      bool
+	}{
+		{
+			name: "Watch settings should be passed to vault-env",
+			annotations: map[string]string{
+				"vault.security/watch-interval": "1m",
+				"vault.security/watch-action":   "signal",
+				"vault.security/watch-signal":   "usr1",
+			},
+			expEnv: []corev1.EnvVar{
+				{Name: "VAULT_ENV_SUPERVISE", Value: "true"},
+				{Name: "VAULT_WATCH_INTERVAL", Value: "1m"},
+				{Name: "VAULT_WATCH_ACTION", Value: "signal"},
+				{Name: "VAULT_WATCH_SIGNAL", Value: "usr1"},
+			},
+		}, {
+			name:        "Invalid intervals should be rejected",
+			annotations: map[string]string{"vault.security/watch-interval": "soon"},
+			expErr:      true,
+		}, {
+			name: "Unknown actions should be rejected",
+			annotations: map[string]string{
+				"vault.security/watch-interval": "1m",
+				"vault.security/watch-action":   "reload",
+			},
+			expErr: true,
+		}, {
+			name: "Signals vault-env can't send should be rejected",
+			annotations: map[string]string{
+				"vault.security/watch-interval": "1m",
+				"vault.security/watch-signal":   "SIGKILL",
+			},
+			expErr: true,
+		},
+	}
+
+	wh.InitConfig()
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pod := newVaultPod("test-pod-with-watch", testCase.annotations)
+
+			_, err := wh.VaultSecretsMutator(context.TODO(), pod)
+			if testCase.expErr {
+				assert.Error(err)
+				return
+			}
+			if !assert.NoError(err) {
+				return
+			}
+			for _, env := range testCase.expEnv {
+				assert.Contains(pod.Spec.Containers[0].Env, env)
+			}
+		})
+	}
+}
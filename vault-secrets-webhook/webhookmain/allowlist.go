@@ -0,0 +1,93 @@
+package webhookmain
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// vaultAgentAddrEnv overrides VAULT_ADDR in the vault client used by vault-env
+const vaultAgentAddrEnv = "VAULT_AGENT_ADDR"
+
+// normalizeVaultAddr returns addr as scheme://host:port/path so equivalent addresses compare equal
+func normalizeVaultAddr(addr string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(addr))
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q is not a http or https URL without credentials, query or fragment", addr)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return u.Scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port) + strings.TrimSuffix(u.Path, "/"), nil
+}
+
+// vaultAddrAllowlist returns the normalized addresses of the comma separated
+// vault_addr_allowlist, an empty allowlist allows every address
+func vaultAddrAllowlist() ([]string, error) {
+	var allowlist []string
+	for _, addr := range strings.Split(viper.GetString("vault_addr_allowlist"), ",") {
+		if strings.TrimSpace(addr) == "" {
+			continue
+		}
+		normalized, err := normalizeVaultAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing vault address allowlist - %s", err)
+		}
+		allowlist = append(allowlist, normalized)
+	}
+	return allowlist, nil
+}
+
+func vaultAddrAllowed(addr string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	normalized, err := normalizeVaultAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowlist {
+		if normalized == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateVaultAddr checks the vault address of the pod and any VAULT_AGENT_ADDR set in
+// its containers against the allowlist, vault-env sends the service account token there
+func validateVaultAddr(vaultConfig VaultConfig, podSpec *corev1.PodSpec, sources *envSources) error {
+	allowlist, err := vaultAddrAllowlist()
+	if err != nil || len(allowlist) == 0 {
+		return err
+	}
+
+	if !vaultAddrAllowed(vaultConfig.Addr, allowlist) {
+		return fmt.Errorf("Error validating vault address %q - it is not in the webhook vault address allowlist", vaultConfig.Addr)
+	}
+
+	for _, container := range append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		env, err := sources.containerEnv(container)
+		if err != nil {
+			return err
+		}
+		for _, e := range env {
+			if e.Name == vaultAgentAddrEnv && e.Value != "" && !vaultAddrAllowed(e.Value, allowlist) {
+				return fmt.Errorf("Error validating %s %q of container %s - it is not in the webhook vault address allowlist", vaultAgentAddrEnv, e.Value, container.Name)
+			}
+		}
+	}
+	return nil
+}
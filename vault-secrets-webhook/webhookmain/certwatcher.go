@@ -0,0 +1,133 @@
+package webhookmain
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slok/kubewebhook/pkg/log"
+)
+
+var certificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "tls_certificate_expiry_timestamp_seconds",
+	Help:      "The expiry of the TLS serving certificate in seconds since the epoch.",
+})
+
+// CertWatcher serves the TLS key pair from disk and reloads it when the files change,
+// a key pair that fails to load leaves the current one in place
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	logger   log.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+// NewCertWatcher loads the key pair, it fails if the initial key pair can't be loaded
+func NewCertWatcher(certFile, keyFile string, logger log.Logger) (*CertWatcher, error) {
+	w := &CertWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (w *CertWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+// NotAfter returns the expiry of the current certificate
+func (w *CertWatcher) NotAfter() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.notAfter
+}
+
+// Start watches the directories of the key pair until stopCh is closed, directories are watched
+// instead of files as Secret volumes are updated by swapping a symlink
+func (w *CertWatcher) Start(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{filepath.Dir(w.certFile): true, filepath.Dir(w.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if err := w.reload(); err != nil {
+					w.logger.Errorf("error reloading TLS key pair, keeping the current certificate: %s", err)
+				}
+			case err := <-watcher.Errors:
+				w.logger.Errorf("error watching TLS key pair: %s", err)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *CertWatcher) reload() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	w.mu.Lock()
+	changed := w.cert == nil || !leaf.Equal(w.cert.Leaf)
+	w.cert = &cert
+	w.notAfter = leaf.NotAfter
+	w.mu.Unlock()
+
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	if changed {
+		w.logger.Infof("loaded TLS certificate %s, expires at %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// TLSKeyPairCheck verifies a key pair is loaded and the certificate has not expired
+func TLSKeyPairCheck(watcher *CertWatcher) HealthCheck {
+	return HealthCheck{
+		Name: "tls-keypair",
+		Check: func() error {
+			if notAfter := watcher.NotAfter(); time.Now().After(notAfter) {
+				return fmt.Errorf("certificate expired at %s", notAfter)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,109 @@
+package webhookmain
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// vaultTemplateData is available to the default role and path templates
+type vaultTemplateData struct {
+	Namespace          string
+	Name               string
+	ServiceAccountName string
+	Labels             map[string]string
+}
+
+func newVaultTemplateData(obj metav1.Object, podMeta metav1.Object, podSpec *corev1.PodSpec, namespace string) vaultTemplateData {
+	serviceAccountName := podSpec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+
+	return vaultTemplateData{
+		Namespace:          namespace,
+		Name:               workloadName(obj, podMeta),
+		ServiceAccountName: serviceAccountName,
+		Labels:             podMeta.GetLabels(),
+	}
+}
+
+// workloadName returns the name of the workload obj belongs to, pods created by a controller
+// are named after it, e.g. app for a pod of the ReplicaSet app-5d8f7c9b4 of the Deployment app
+func workloadName(obj metav1.Object, podMeta metav1.Object) string {
+	if owner := metav1.GetControllerOf(obj); owner != nil {
+		// ReplicaSets of a Deployment are named <deployment>-<pod-template-hash>
+		if hash := podMeta.GetLabels()["pod-template-hash"]; owner.Kind == "ReplicaSet" && hash != "" {
+			return strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		return owner.Name
+	}
+
+	// pods created without a controller may only have a generateName like app-
+	if name := obj.GetName(); name != "" {
+		return name
+	}
+	return strings.TrimSuffix(obj.GetGenerateName(), "-")
+}
+
+func renderVaultTemplate(name string, text string, data vaultTemplateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing %s %q: %s", name, text, err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("Error rendering %s %q: %s", name, text, err)
+	}
+	return rendered.String(), nil
+}
+
+// applyVaultDefaults fills the settings neither the pod nor its namespace set
+// from the webhook configuration
+func applyVaultDefaults(vaultConfig *VaultConfig, data vaultTemplateData) error {
+	if vaultConfig.Addr == "" {
+		vaultConfig.Addr = viper.GetString("default_vault_addr")
+	}
+	if vaultConfig.AuthMethod == "" {
+		vaultConfig.AuthMethod = viper.GetString("default_vault_auth_method")
+	}
+	if vaultConfig.VaultNamespace == "" {
+		vaultConfig.VaultNamespace = viper.GetString("default_vault_namespace")
+	}
+	// the default auth path is the mount of the Kubernetes auth method
+	if vaultConfig.AuthPath == "" && isKubernetesAuth(vaultConfig.AuthMethod) {
+		vaultConfig.AuthPath = viper.GetString("default_vault_auth_path")
+	}
+	if vaultConfig.TokenAudience == "" {
+		vaultConfig.TokenAudience = viper.GetString("service_account_token_audience")
+	}
+	if vaultConfig.TokenExpiration == "" {
+		vaultConfig.TokenExpiration = viper.GetString("service_account_token_expiration")
+	}
+	if vaultConfig.TLSSecretName == "" {
+		vaultConfig.TLSSecretName = viper.GetString("default_vault_tls_secret_name")
+	}
+
+	if roleTemplate := viper.GetString("default_vault_role_template"); vaultConfig.Role == "" && roleTemplate != "" && authMethodRequiresRole(vaultConfig.AuthMethod) {
+		role, err := renderVaultTemplate("default_vault_role_template", roleTemplate, data)
+		if err != nil {
+			return err
+		}
+		vaultConfig.Role = role
+	}
+
+	if pathTemplate := viper.GetString("default_vault_path_template"); vaultConfig.Path == "" && pathTemplate != "" {
+		path, err := renderVaultTemplate("default_vault_path_template", pathTemplate, data)
+		if err != nil {
+			return err
+		}
+		vaultConfig.Path = path
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package webhookmain
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// authCredential is a file vault-env reads a login credential from
+type authCredential struct {
+	annotation string
+	env        string
+	// method is the auth method reading the file
+	method string
+	// defaultFile is the file in the auth secret used when the annotation is unset, the
+	// credential is optional if empty
+	defaultFile string
+	file        func(vaultConfig VaultConfig) string
+}
+
+var authCredentials = []authCredential{
+	{
+		annotation:  "vault.security/vault-role-id-file",
+		env:         "VAULT_ROLE_ID_FILE",
+		method:      "approle",
+		defaultFile: "role-id",
+		file:        func(vaultConfig VaultConfig) string { return vaultConfig.RoleIDFile },
+	}, {
+		annotation:  "vault.security/vault-secret-id-file",
+		env:         "VAULT_SECRET_ID_FILE",
+		method:      "approle",
+		defaultFile: "secret-id",
+		file:        func(vaultConfig VaultConfig) string { return vaultConfig.SecretIDFile },
+	}, {
+		annotation:  "vault.security/vault-token-file",
+		env:         "VAULT_TOKEN_FILE",
+		method:      "token",
+		defaultFile: "token",
+		file:        func(vaultConfig VaultConfig) string { return vaultConfig.TokenFile },
+	}, {
+		// the service account token is used without one
+		annotation: "vault.security/vault-jwt-file",
+		env:        "VAULT_JWT_FILE",
+		method:     "jwt",
+		file:       func(vaultConfig VaultConfig) string { return vaultConfig.JWTFile },
+	}, {
+		annotation:  "vault.security/vault-client-cert-file",
+		env:         "VAULT_CLIENT_CERT",
+		method:      "cert",
+		defaultFile: corev1.TLSCertKey,
+		file:        func(vaultConfig VaultConfig) string { return vaultConfig.ClientCertFile },
+	}, {
+		annotation:  "vault.security/vault-client-key-file",
+		env:         "VAULT_CLIENT_KEY",
+		method:      "cert",
+		defaultFile: corev1.TLSPrivateKeyKey,
+		file:        func(vaultConfig VaultConfig) string { return vaultConfig.ClientKeyFile },
+	},
+}
+
+// credentialFile returns the annotated file of the credential, else its default file when
+// the auth secret is mounted
+func (c authCredential) credentialFile(vaultConfig VaultConfig) string {
+	if file := c.file(vaultConfig); file != "" {
+		return file
+	}
+	if vaultConfig.AuthSecretName != "" {
+		return c.defaultFile
+	}
+	return ""
+}
+
+// validateAuthCredentials checks every credential file the auth method reads is given, and
+// that no credential of another method is
+func validateAuthCredentials(vaultConfig VaultConfig) error {
+	method := vaultConfig.AuthMethod
+	if vaultConfig.AuthSecretName != "" && isKubernetesAuth(method) {
+		return fmt.Errorf("Error parsing vault auth secret %q - \"vault.security/vault-auth-secret-name\" isn't used by the kubernetes auth method", vaultConfig.AuthSecretName)
+	}
+
+	for _, credential := range authCredentials {
+		file := credential.file(vaultConfig)
+		if credential.method != method {
+			if file != "" {
+				return fmt.Errorf("Error parsing %q - it is only used by the %s auth method", credential.annotation, credential.method)
+			}
+			continue
+		}
+
+		file = credential.credentialFile(vaultConfig)
+		if file == "" {
+			if credential.defaultFile == "" {
+				continue
+			}
+			return fmt.Errorf("Error getting %s credentials - set the annotation \"vault.security/vault-auth-secret-name\" or %q", method, credential.annotation)
+		}
+		if path.IsAbs(file) {
+			continue
+		}
+		if vaultConfig.AuthSecretName == "" {
+			return fmt.Errorf("Error parsing %q - relative files are read from the Secret in \"vault.security/vault-auth-secret-name\", set it or use an absolute path", credential.annotation)
+		}
+		if clean := path.Clean(file); clean != file || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("Error parsing %q - %q must be a key of the Secret in \"vault.security/vault-auth-secret-name\"", credential.annotation, file)
+		}
+	}
+	return nil
+}
+
+// authCredentialsConfig returns the env vars pointing vault-env to the credential files and
+// the mount of the auth secret, relative files are keys of the auth secret, absolute ones
+// must be mounted by the pod itself
+func authCredentialsConfig(vaultConfig VaultConfig, names injectedNames) ([]corev1.EnvVar, []corev1.VolumeMount) {
+	var env []corev1.EnvVar
+	for _, credential := range authCredentials {
+		if credential.method != vaultConfig.AuthMethod {
+			continue
+		}
+		file := credential.credentialFile(vaultConfig)
+		if file == "" {
+			continue
+		}
+		if !path.IsAbs(file) {
+			file = path.Join(names.AuthMountPath, file)
+		}
+		env = append(env, corev1.EnvVar{
+			Name:  credential.env,
+			Value: file,
+		})
+	}
+
+	var volumeMounts []corev1.VolumeMount
+	if vaultConfig.AuthSecretName != "" {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      names.AuthVolume,
+			MountPath: names.AuthMountPath,
+			ReadOnly:  true,
+		})
+	}
+	return env, volumeMounts
+}
+
+func getAuthVolume(vaultConfig VaultConfig, names injectedNames) corev1.Volume {
+	return corev1.Volume{
+		Name: names.AuthVolume,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: vaultConfig.AuthSecretName,
+			},
+		},
+	}
+}
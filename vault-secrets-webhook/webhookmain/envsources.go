@@ -0,0 +1,177 @@
+package webhookmain
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// envSources reads the ConfigMaps and Secrets referenced by container env, each one once per pod
+type envSources struct {
+	client     kubernetes.Interface
+	namespace  string
+	configMaps map[string]map[string]string
+	secrets    map[string]map[string]string
+	// warnMissing logs missing refs instead of rejecting them, workloads are often applied
+	// before their ConfigMaps and Secrets
+	warnMissing bool
+	warned      map[string]bool
+}
+
+func newEnvSources(client kubernetes.Interface, namespace string, warnMissing bool) *envSources {
+	return &envSources{
+		client:      client,
+		namespace:   namespace,
+		configMaps:  map[string]map[string]string{},
+		secrets:     map[string]map[string]string{},
+		warnMissing: warnMissing,
+		warned:      map[string]bool{},
+	}
+}
+
+// missing returns err for pods, for workload templates it is logged once and nil is returned
+func (s *envSources) missing(err error) error {
+	if !s.warnMissing {
+		return err
+	}
+	if !s.warned[err.Error()] {
+		s.warned[err.Error()] = true
+		logger.Warnf("%s, admitting the workload anyway", err)
+	}
+	return nil
+}
+
+// containerEnv returns the env of the container as the kubelet will see it, values pulled in
+// with envFrom and valueFrom are read from their ConfigMaps and Secrets, env entries take
+// precedence over envFrom ones
+func (s *envSources) containerEnv(container corev1.Container) ([]corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	index := map[string]int{}
+	set := func(name, value string) {
+		if i, ok := index[name]; ok {
+			env[i].Value = value
+			return
+		}
+		index[name] = len(env)
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+
+	for _, envFrom := range container.EnvFrom {
+		var data map[string]string
+		var err error
+		switch {
+		case envFrom.ConfigMapRef != nil:
+			data, err = s.configMap(envFrom.ConfigMapRef.Name, isOptional(envFrom.ConfigMapRef.Optional))
+		case envFrom.SecretRef != nil:
+			data, err = s.secret(envFrom.SecretRef.Name, isOptional(envFrom.SecretRef.Optional))
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			set(envFrom.Prefix+key, data[key])
+		}
+	}
+
+	for _, e := range container.Env {
+		if e.ValueFrom == nil {
+			set(e.Name, e.Value)
+			continue
+		}
+
+		var data map[string]string
+		var key, source string
+		var optional bool
+		var err error
+		switch {
+		case e.ValueFrom.ConfigMapKeyRef != nil:
+			key = e.ValueFrom.ConfigMapKeyRef.Key
+			source = "ConfigMap " + e.ValueFrom.ConfigMapKeyRef.Name
+			optional = isOptional(e.ValueFrom.ConfigMapKeyRef.Optional)
+			data, err = s.configMap(e.ValueFrom.ConfigMapKeyRef.Name, optional)
+		case e.ValueFrom.SecretKeyRef != nil:
+			key = e.ValueFrom.SecretKeyRef.Key
+			source = "Secret " + e.ValueFrom.SecretKeyRef.Name
+			optional = isOptional(e.ValueFrom.SecretKeyRef.Optional)
+			data, err = s.secret(e.ValueFrom.SecretKeyRef.Name, optional)
+		default:
+			// field and resource refs never carry vault references
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, ok := data[key]
+		if !ok && !optional && data != nil {
+			if err := s.missing(fmt.Errorf("Error reading env %s of container %s - key %s is missing in %s, the pod would not start", e.Name, container.Name, key, source)); err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			set(e.Name, value)
+		}
+	}
+
+	return env, nil
+}
+
+// isOptional reports whether a missing ConfigMap, Secret or key is allowed
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// configMap returns the data of the ConfigMap, nil if it is missing and optional or in a workload
+func (s *envSources) configMap(name string, optional bool) (map[string]string, error) {
+	data, ok := s.configMaps[name]
+	if !ok && s.client != nil {
+		configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("Error reading ConfigMap %s referenced by the pod env: %s", name, err)
+		}
+		if err == nil {
+			data = map[string]string{}
+			for key, value := range configMap.Data {
+				data[key] = value
+			}
+		}
+		s.configMaps[name] = data
+	}
+
+	// without a client nothing can be checked, the kubelet reports missing refs
+	if data == nil && s.client != nil && !optional {
+		return nil, s.missing(fmt.Errorf("Error reading ConfigMap %s referenced by the pod - it does not exist and the reference is not optional, the pod would not start", name))
+	}
+	return data, nil
+}
+
+// secret returns the data of the Secret, nil if it is missing and optional or in a workload
+func (s *envSources) secret(name string, optional bool) (map[string]string, error) {
+	data, ok := s.secrets[name]
+	if !ok && s.client != nil {
+		secret, err := s.client.CoreV1().Secrets(s.namespace).Get(name, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("Error reading Secret %s referenced by the pod env: %s", name, err)
+		}
+		if err == nil {
+			data = make(map[string]string, len(secret.Data))
+			for key, value := range secret.Data {
+				data[key] = string(value)
+			}
+		}
+		s.secrets[name] = data
+	}
+
+	if data == nil && s.client != nil && !optional {
+		return nil, s.missing(fmt.Errorf("Error reading Secret %s referenced by the pod - it does not exist and the reference is not optional, the pod would not start", name))
+	}
+	return data, nil
+}
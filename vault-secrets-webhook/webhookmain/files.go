@@ -0,0 +1,202 @@
+package webhookmain
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	secretFileAnnotationPrefix = "vault.security/file."
+	// secret files are written to this sub directory of the vault-env volume
+	secretFilesSubPath = "secrets"
+)
+
+var fileOwnerRegexp = regexp.MustCompile(`^([0-9]+(:[0-9]+)?|:[0-9]+)$`)
+
+// parseSecretFiles collects the vault.security/file.<name>: <path>#<key> annotations
+func parseSecretFiles(annotations map[string]string) map[string]string {
+	files := map[string]string{}
+	for annotation, ref := range annotations {
+		if strings.HasPrefix(annotation, secretFileAnnotationPrefix) {
+			files[strings.TrimPrefix(annotation, secretFileAnnotationPrefix)] = ref
+		}
+	}
+	return files
+}
+
+// hasSecretFiles reports whether files or file templates are rendered for the pod
+func hasSecretFiles(vaultConfig VaultConfig) bool {
+	return len(vaultConfig.Files) > 0 || len(vaultConfig.Templates) > 0 || vaultConfig.TemplateConfigMap != ""
+}
+
+func validateSecretFiles(vaultConfig VaultConfig) error {
+	for name, ref := range vaultConfig.Files {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/,=") {
+			return fmt.Errorf("Error parsing secret file %q - \"%s<name>\" must be a plain file name", name, secretFileAnnotationPrefix)
+		}
+		if ref == "" || strings.Contains(ref, ",") {
+			return fmt.Errorf("Error parsing secret file %q - expected a <path>#<key> or <key> value", name)
+		}
+		if vaultConfig.Path == "" && !strings.Contains(ref, "#") {
+			return fmt.Errorf("Error getting vault path for secret file %q - set the annotation \"vault.security/vault-path\" or use the form <path>#<key>", name)
+		}
+	}
+	if vaultConfig.FileMountPath != "" && !path.IsAbs(vaultConfig.FileMountPath) {
+		return fmt.Errorf("Error parsing file mount path %q - \"vault.security/file-mount-path\" must be an absolute path", vaultConfig.FileMountPath)
+	}
+	if vaultConfig.FileMode != "" {
+		if _, err := strconv.ParseUint(vaultConfig.FileMode, 8, 32); err != nil {
+			return fmt.Errorf("Error parsing file mode %q - \"vault.security/file-mode\" must be an octal mode like 0400", vaultConfig.FileMode)
+		}
+	}
+	if vaultConfig.FileOwner != "" && !fileOwnerRegexp.MatchString(vaultConfig.FileOwner) {
+		return fmt.Errorf("Error parsing file owner %q - \"vault.security/file-owner\" must be <uid>[:<gid>] or :<gid>", vaultConfig.FileOwner)
+	}
+	return nil
+}
+
+// withDefaultFileOwner sets the file owner of pods without the file-owner annotation to the
+// user and group the first container runs with, so non-root containers can read the files.
+// The group is the fsGroup or runAsGroup, without a file-mode the group may read the files
+func withDefaultFileOwner(podSpec *corev1.PodSpec, vaultConfig VaultConfig) VaultConfig {
+	if vaultConfig.FileOwner != "" || !hasSecretFiles(vaultConfig) {
+		return vaultConfig
+	}
+
+	var uid, gid *int64
+	if podSecurityContext := podSpec.SecurityContext; podSecurityContext != nil {
+		uid = podSecurityContext.RunAsUser
+		gid = podSecurityContext.RunAsGroup
+	}
+	if len(podSpec.Containers) > 0 && podSpec.Containers[0].SecurityContext != nil {
+		securityContext := podSpec.Containers[0].SecurityContext
+		if securityContext.RunAsUser != nil {
+			uid = securityContext.RunAsUser
+		}
+		if securityContext.RunAsGroup != nil {
+			gid = securityContext.RunAsGroup
+		}
+	}
+	if podSpec.SecurityContext != nil && podSpec.SecurityContext.FSGroup != nil {
+		gid = podSpec.SecurityContext.FSGroup
+	}
+
+	if uid != nil {
+		vaultConfig.FileOwner = strconv.FormatInt(*uid, 10)
+	}
+	if gid != nil {
+		vaultConfig.FileOwner += ":" + strconv.FormatInt(*gid, 10)
+		if vaultConfig.FileMode == "" {
+			vaultConfig.FileMode = "0440"
+		}
+	}
+	return vaultConfig
+}
+
+// secretFilesEnv transforms the secret file annotations to env vars for vault-env execution
+func secretFilesEnv(vaultConfig VaultConfig, names injectedNames) []corev1.EnvVar {
+	fileNames := make([]string, 0, len(vaultConfig.Files))
+	for name := range vaultConfig.Files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+
+	files := make([]string, 0, len(fileNames))
+	for _, name := range fileNames {
+		files = append(files, name+"="+vaultConfig.Files[name])
+	}
+
+	return []corev1.EnvVar{
+		{
+			Name:  "VAULT_FILES",
+			Value: strings.Join(files, ","),
+		}, {
+			Name:  "VAULT_FILES_DIR",
+			Value: names.filesDir(),
+		}, {
+			Name:  "VAULT_FILES_MODE",
+			Value: vaultConfig.FileMode,
+		}, {
+			Name:  "VAULT_FILES_OWNER",
+			Value: vaultConfig.FileOwner,
+		},
+	}
+}
+
+// refreshesSecretFiles reports whether container rewrites the secret files when they change,
+// only the first container does so, the files init container writes them before any container starts
+func refreshesSecretFiles(container corev1.Container, podSpec *corev1.PodSpec, vaultConfig VaultConfig) bool {
+	if !hasSecretFiles(vaultConfig) || vaultConfig.WatchInterval == "" || len(podSpec.Containers) == 0 {
+		return false
+	}
+	return container.Name == podSpec.Containers[0].Name
+}
+
+// secretFilesConfig returns the env vars and volume mounts vault-env needs to write the secret files
+func secretFilesConfig(vaultConfig VaultConfig, names injectedNames) ([]corev1.EnvVar, []corev1.VolumeMount, error) {
+	env := secretFilesEnv(vaultConfig, names)
+
+	templatesEnv, err := templatesEnv(vaultConfig, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	env = append(env, templatesEnv...)
+
+	var volumeMounts []corev1.VolumeMount
+	if vaultConfig.TemplateConfigMap != "" {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      names.TemplatesVolume,
+			MountPath: names.templatesMountPath(),
+			ReadOnly:  true,
+		})
+	}
+	return env, volumeMounts, nil
+}
+
+// secretFilesMounts returns the read-only mount of the secret files at the file mount path,
+// or at the files directory of the vault-env volume
+func secretFilesMounts(vaultConfig VaultConfig, names injectedNames) []corev1.VolumeMount {
+	mountPath := vaultConfig.FileMountPath
+	if mountPath == "" {
+		mountPath = names.filesDir()
+	}
+	return []corev1.VolumeMount{
+		{
+			Name:      names.EnvVolume,
+			MountPath: mountPath,
+			SubPath:   secretFilesSubPath,
+			ReadOnly:  true,
+		},
+	}
+}
+
+// getSecretFilesContainer runs vault-env without a command, so it writes the secret files and exits
+func getSecretFilesContainer(vaultConfig VaultConfig, names injectedNames) (corev1.Container, error) {
+	env, volumeMounts := vaultEnvConfig(vaultConfig, names)
+
+	filesEnv, filesMounts, err := secretFilesConfig(vaultConfig, names)
+	if err != nil {
+		return corev1.Container{}, err
+	}
+
+	return corev1.Container{
+		Name:            names.FilesInitContainer,
+		Image:           viper.GetString("vault_env_image"),
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{vaultEnvImageBinary},
+		Env:             append(env, filesEnv...),
+		VolumeMounts: append(append([]corev1.VolumeMount{
+			{
+				Name:      names.EnvVolume,
+				MountPath: names.EnvMountPath,
+			},
+		}, volumeMounts...), filesMounts...),
+	}, nil
+}
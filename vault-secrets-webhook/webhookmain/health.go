@@ -0,0 +1,140 @@
+package webhookmain
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// healthCheckTimeout bounds all readiness checks together, a hanging dependency makes the
+// webhook unready, it must stay below the timeoutSeconds of the readiness probe
+const healthCheckTimeout = 4 * time.Second
+
+// HealthCheck is a named readiness check
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// HealthzHandler reports the process is alive
+func HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, "ok")
+	})
+}
+
+// ReadyzHandler reports the webhook ready when all checks pass
+func ReadyzHandler(checks ...HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report strings.Builder
+		ready := true
+		for i, err := range runHealthChecks(checks) {
+			check := checks[i]
+			if err != nil {
+				ready = false
+				fmt.Fprintf(&report, "[-] %s failed: %s\n", check.Name, err)
+			} else {
+				fmt.Fprintf(&report, "[+] %s ok\n", check.Name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, report.String())
+	})
+}
+
+// runHealthChecks runs the checks in parallel and returns their results in order,
+// checks still running when healthCheckTimeout expires fail
+func runHealthChecks(checks []HealthCheck) []error {
+	results := make([]chan error, len(checks))
+	for i, check := range checks {
+		results[i] = make(chan error, 1)
+		go func(check HealthCheck, result chan<- error) {
+			result <- check.Check()
+		}(check, results[i])
+	}
+
+	deadline := time.NewTimer(healthCheckTimeout)
+	defer deadline.Stop()
+	expired := false
+
+	errs := make([]error, len(checks))
+	for i, result := range results {
+		if !expired {
+			select {
+			case errs[i] = <-result:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		// after the deadline only the checks that already finished are reported
+		select {
+		case errs[i] = <-result:
+		default:
+			errs[i] = fmt.Errorf("timed out after %s", healthCheckTimeout)
+		}
+	}
+	return errs
+}
+
+// KubernetesAPICheck verifies the API server answers, the check passes without a client
+// as the webhook then runs without namespace defaults and imagePullSecrets
+func KubernetesAPICheck(client kubernetes.Interface) HealthCheck {
+	return HealthCheck{
+		Name: "kubernetes-api",
+		Check: func() error {
+			if client == nil {
+				return nil
+			}
+			_, err := client.Discovery().ServerVersion()
+			return err
+		},
+	}
+}
+
+// VaultHealthCheck verifies the vault at addr is initialized and unsealed, standbys count as healthy
+func VaultHealthCheck(addr, caFile string) (HealthCheck, error) {
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return HealthCheck{}, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return HealthCheck{}, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	client := &http.Client{
+		Timeout:   healthCheckTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	url := strings.TrimSuffix(addr, "/") + "/v1/sys/health?standbyok=true&perfstandbyok=true"
+
+	return HealthCheck{
+		Name: "vault",
+		Check: func() error {
+			resp, err := client.Get(url)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s answered sys/health with %s", addr, resp.Status)
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,205 @@
+package webhookmain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/spf13/viper"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sjson "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+var (
+	yamlSerializer = k8sjson.NewYAMLSerializer(k8sjson.DefaultMetaFactory, scheme.Scheme, scheme.Scheme)
+	jsonSerializer = k8sjson.NewSerializer(k8sjson.DefaultMetaFactory, scheme.Scheme, scheme.Scheme, false)
+)
+
+// InjectMain runs the inject subcommand, it prints the manifests read from a file or stdin
+// with vault-env injected the same way the webhook would, except that annotations of the
+// namespace aren't applied as defaults as no cluster is read
+func InjectMain(args []string) {
+	flags := flag.NewFlagSet("inject", flag.ExitOnError)
+	filename := flags.String("filename", "-", "file to read the manifests from, - reads stdin")
+	flags.StringVar(filename, "f", "-", "shorthand for -filename")
+	namespace := flags.String("namespace", "default", "namespace of manifests without one, used for policy rules, namespace annotation defaults are not applied offline")
+	flags.StringVar(namespace, "n", "default", "shorthand for -namespace")
+	failOnError := flags.Bool("fail-on-error", false, "exit non-zero when an object can't be injected instead of printing it unchanged")
+	flags.Parse(args)
+
+	InitConfig()
+	l, err := NewLogger(viper.GetString("log_level"), "text")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating logger: %s\n", err)
+		os.Exit(1)
+	}
+	SetLogger(l)
+
+	p, err := LoadPolicy(viper.GetString("policy_file"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading policy: %s\n", err)
+		os.Exit(1)
+	}
+	SetPolicy(p)
+
+	in := os.Stdin
+	if *filename != "-" {
+		if in, err = os.Open(*filename); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading manifests: %s\n", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+
+	if err := Inject(in, os.Stdout, *namespace, *failOnError); err != nil {
+		fmt.Fprintf(os.Stderr, "error injecting vault-env: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Inject reads multi-document YAML from r and writes it to w with vault-env injected into every
+// object with a pod spec, objects that fail injection are written unchanged with a warning
+// unless failOnError is set, documents of unknown kinds are passed through
+func Inject(r io.Reader, w io.Writer, namespace string, failOnError bool) error {
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+	first := true
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		out, err := injectDocument(doc, namespace)
+		if err != nil {
+			if failOnError {
+				return err
+			}
+			logger.Warnf("%s, leaving it unchanged", err)
+			out = doc
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// injectDocument returns the document with vault-env injected, unchanged documents are returned as is
+func injectDocument(doc []byte, namespace string) ([]byte, error) {
+	obj, err := decodeObject(doc)
+	if runtime.IsNotRegisteredError(err) {
+		return doc, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	mutated, err := injectObject(obj, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if equality.Semantic.DeepEqual(obj, mutated) {
+		return doc, nil
+	}
+
+	var out bytes.Buffer
+	if err := yamlSerializer.Encode(mutated, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func decodeObject(data []byte) (runtime.Object, error) {
+	obj, gvk, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(*gvk)
+	return obj, nil
+}
+
+// injectObject returns a mutated copy of obj, lists have each of their items mutated
+func injectObject(obj runtime.Object, namespace string) (runtime.Object, error) {
+	obj = obj.DeepCopyObject()
+
+	if list, ok := obj.(*corev1.List); ok {
+		for i, item := range list.Items {
+			itemObj, err := decodeObject(item.Raw)
+			if runtime.IsNotRegisteredError(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			mutated, err := injectObject(itemObj, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if equality.Semantic.DeepEqual(itemObj, mutated) {
+				continue
+			}
+
+			var raw bytes.Buffer
+			if err := jsonSerializer.Encode(mutated, &raw); err != nil {
+				return nil, err
+			}
+			list.Items[i] = runtime.RawExtension{Raw: bytes.TrimSpace(raw.Bytes())}
+		}
+		return list, nil
+	}
+
+	if meta.IsListType(obj) {
+		items, err := meta.ExtractList(obj)
+		if err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			if items[i], err = injectObject(item, namespace); err != nil {
+				return nil, err
+			}
+		}
+		return obj, meta.SetList(obj, items)
+	}
+
+	metaObj, ok := obj.(metav1.Object)
+	if !ok {
+		return obj, nil
+	}
+
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{
+		Namespace: namespace,
+		Operation: admissionv1beta1.Create,
+	})
+	if _, err := VaultSecretsMutator(ctx, metaObj); err != nil {
+		return nil, fmt.Errorf("%s %s: %s", obj.GetObjectKind().GroupVersionKind().Kind, objectName(metaObj), err)
+	}
+	return obj, nil
+}
+
+func objectName(obj metav1.Object) string {
+	if obj.GetName() == "" {
+		return obj.GetGenerateName()
+	}
+	return obj.GetName()
+}
@@ -0,0 +1,151 @@
+package webhookmain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// resourceList is the input and output of a KRM function as defined by the kustomize and kpt functions spec
+type resourceList struct {
+	APIVersion     string            `json:"apiVersion"`
+	Kind           string            `json:"kind"`
+	Items          []json.RawMessage `json:"items"`
+	FunctionConfig json.RawMessage   `json:"functionConfig,omitempty"`
+	Results        []krmResult       `json:"results,omitempty"`
+}
+
+type krmResult struct {
+	Message     string          `json:"message"`
+	Severity    string          `json:"severity"`
+	ResourceRef *krmResourceRef `json:"resourceRef,omitempty"`
+}
+
+type krmResourceRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+// krmFunctionConfig is read from the data of a ConfigMap passed as functionConfig
+type krmFunctionConfig struct {
+	Data struct {
+		// Namespace is used for resources without one
+		Namespace string `json:"namespace"`
+	} `json:"data"`
+}
+
+// KRMMain runs the injector as a KRM function reading a ResourceList from stdin, it exits
+// non-zero when a resource could not be injected
+func KRMMain() {
+	InitConfig()
+	l, err := NewLogger(viper.GetString("log_level"), "text")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating logger: %s\n", err)
+		os.Exit(1)
+	}
+	SetLogger(l)
+
+	p, err := LoadPolicy(viper.GetString("policy_file"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading policy: %s\n", err)
+		os.Exit(1)
+	}
+	SetPolicy(p)
+
+	failed, err := RunKRMFunction(os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error running KRM function: %s\n", err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// RunKRMFunction injects vault-env into the items of the ResourceList read from r and writes the
+// ResourceList with a result for every resource to w, failed reports whether any resource failed
+func RunKRMFunction(r io.Reader, w io.Writer) (failed bool, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+
+	var list resourceList
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return false, fmt.Errorf("failed to parse ResourceList: %s", err)
+	}
+	if list.Kind != "ResourceList" {
+		return false, fmt.Errorf("expected a ResourceList, got kind %q", list.Kind)
+	}
+
+	namespace := "default"
+	if len(list.FunctionConfig) > 0 {
+		var config krmFunctionConfig
+		if err := json.Unmarshal(list.FunctionConfig, &config); err != nil {
+			return false, fmt.Errorf("failed to parse functionConfig: %s", err)
+		}
+		if config.Data.Namespace != "" {
+			namespace = config.Data.Namespace
+		}
+	}
+
+	for i, item := range list.Items {
+		obj, err := decodeObject(item)
+		if runtime.IsNotRegisteredError(err) {
+			continue
+		} else if err != nil {
+			failed = true
+			list.Results = append(list.Results, krmResult{Message: err.Error(), Severity: "error"})
+			continue
+		}
+
+		mutated, err := injectObject(obj, namespace)
+		if err != nil {
+			failed = true
+			list.Results = append(list.Results, krmResult{Message: err.Error(), Severity: "error", ResourceRef: resourceRef(obj)})
+			continue
+		}
+		if equality.Semantic.DeepEqual(obj, mutated) {
+			continue
+		}
+
+		var out bytes.Buffer
+		if err := jsonSerializer.Encode(mutated, &out); err != nil {
+			return false, err
+		}
+		list.Items[i] = out.Bytes()
+		list.Results = append(list.Results, krmResult{Message: "vault-env injected", Severity: "info", ResourceRef: resourceRef(obj)})
+	}
+
+	out, err := json.Marshal(list)
+	if err != nil {
+		return false, err
+	}
+	out, err = yaml.JSONToYAML(out)
+	if err != nil {
+		return false, err
+	}
+	_, err = w.Write(out)
+	return failed, err
+}
+
+func resourceRef(obj runtime.Object) *krmResourceRef {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	ref := &krmResourceRef{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind}
+	if accessor, err := meta.Accessor(obj); err == nil {
+		ref.Name = objectName(accessor)
+		ref.Namespace = accessor.GetNamespace()
+	}
+	return ref
+}
@@ -0,0 +1,74 @@
+package webhookmain
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// logger is used by the webhook and, as it satisfies the kubewebhook Logger, by kubewebhook
+var logger = logrus.New()
+
+// SetLogger replaces the webhook logger
+func SetLogger(l *logrus.Logger) {
+	logger = l
+}
+
+// NewLogger creates a logger writing to stderr in the given format, json or text
+func NewLogger(level, format string) (*logrus.Logger, error) {
+	l := logrus.New()
+	l.SetOutput(os.Stderr)
+
+	switch format {
+	case "json":
+		l.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		l.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be json or text", format)
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	l.SetLevel(lvl)
+	return l, nil
+}
+
+// validateVaultEnvLogging checks the log settings passed to vault-env, which fails at
+// container start on values it can't parse
+func validateVaultEnvLogging(format, level string) error {
+	if format != "" && format != "json" && format != "text" {
+		return fmt.Errorf("invalid vault-env log format %q, must be json or text", format)
+	}
+	if level != "" {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("invalid vault-env log level %q: %s", level, err)
+		}
+	}
+	return nil
+}
+
+// requestLogger returns a logger carrying the admission request and object identity
+func requestLogger(ctx context.Context, obj metav1.Object) *logrus.Entry {
+	fields := logrus.Fields{
+		"namespace": requestNamespace(ctx, obj),
+	}
+	if name := obj.GetName(); name != "" {
+		fields["name"] = name
+	}
+	if generateName := obj.GetGenerateName(); generateName != "" {
+		fields["generateName"] = generateName
+	}
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		fields["uid"] = string(ar.UID)
+		fields["operation"] = string(ar.Operation)
+		fields["kind"] = ar.Kind.Kind
+	}
+	return logger.WithFields(fields)
+}
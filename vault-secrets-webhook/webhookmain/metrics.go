@@ -0,0 +1,123 @@
+package webhookmain
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/slok/kubewebhook/pkg/webhook/mutating"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	metricsNamespace = "vault_secrets_webhook"
+
+	resultMutated  = "mutated"
+	resultSkipped  = "skipped"
+	resultRejected = "rejected"
+
+	// reasonMutationFailed labels rejections that carry no specific reason
+	reasonMutationFailed = "mutation_failed"
+)
+
+// admissionRequests and mutationDuration are replaced by RegisterMetrics, so every
+// registry starts counting from zero
+var (
+	admissionRequests = newAdmissionRequests()
+	mutationDuration  = newMutationDuration()
+)
+
+func newAdmissionRequests() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Total number of admission requests by result, rejection reason and namespace.",
+	}, []string{"result", "reason", "namespace"})
+}
+
+func newMutationDuration() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutation_duration_seconds",
+		Help:      "The duration of the vault secrets mutation by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+}
+
+// rejection is an admission error carrying a short reason used as metrics label
+type rejection struct {
+	reason string
+	err    error
+}
+
+func (r rejection) Error() string {
+	return r.err.Error()
+}
+
+func reject(reason string, err error) error {
+	return rejection{reason: reason, err: err}
+}
+
+func rejectionReason(err error) string {
+	if r, ok := err.(rejection); ok {
+		return r.reason
+	}
+	return reasonMutationFailed
+}
+
+// RegisterMetrics registers the webhook metrics on reg, the admission metrics are
+// created for reg and recorded there from now on
+func RegisterMetrics(reg prometheus.Registerer) error {
+	admissionRequests = newAdmissionRequests()
+	mutationDuration = newMutationDuration()
+	for _, collector := range []prometheus.Collector{admissionRequests, mutationDuration, certificateExpiry} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InstrumentMutator records the result and duration of every call to mutator and logs the decision
+func InstrumentMutator(mutator mutating.MutatorFunc) mutating.MutatorFunc {
+	return func(ctx context.Context, obj metav1.Object) (bool, error) {
+		var original runtime.Object
+		if o, ok := obj.(runtime.Object); ok {
+			original = o.DeepCopyObject()
+		}
+
+		start := time.Now()
+		stop, err := mutator(ctx, obj)
+
+		result, reason := resultSkipped, ""
+		if err != nil {
+			result, reason = resultRejected, rejectionReason(err)
+		} else if original != nil && !equality.Semantic.DeepEqual(original, obj) {
+			result = resultMutated
+		}
+
+		duration := time.Since(start)
+		mutationDuration.WithLabelValues(result).Observe(duration.Seconds())
+		admissionRequests.WithLabelValues(result, reason, requestNamespace(ctx, obj)).Inc()
+
+		entry := requestLogger(ctx, obj).WithFields(logrus.Fields{
+			"decision": result,
+			"duration": duration.String(),
+		})
+		if err != nil {
+			entry.WithField("reason", reason).Warnf("rejected: %s", err)
+		} else {
+			entry.Info("admitted")
+		}
+		return stop, err
+	}
+}
+
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
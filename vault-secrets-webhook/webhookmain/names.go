@@ -0,0 +1,201 @@
+package webhookmain
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// vaultEnvImageBinary is the path of vault-env in the vault_env_image
+const vaultEnvImageBinary = "/usr/local/bin/vault-env"
+
+// maxNameSuffix bounds the search for a free name, e.g. vault-env-1 ... vault-env-9
+const maxNameSuffix = 9
+
+const (
+	// legacyInitContainer and legacyTLSVolume were injected before injected_name_prefix
+	// existed, pods injected with them keep them
+	legacyInitContainer = "init"
+	legacyTLSVolume     = "tls"
+)
+
+// injectedNames are the names and mount paths of everything injected into a pod
+type injectedNames struct {
+	InitContainer      string
+	FilesInitContainer string
+	EnvVolume          string
+	TLSVolume          string
+	TemplatesVolume    string
+	TokenVolume        string
+	AuthVolume         string
+	EnvMountPath       string
+	TLSMountPath       string
+	TokenMountPath     string
+	AuthMountPath      string
+}
+
+// vaultEnvBinary is the path vault-env is copied to by the init container
+func (n injectedNames) vaultEnvBinary() string {
+	return path.Join(n.EnvMountPath, "vault-env")
+}
+
+func (n injectedNames) filesDir() string {
+	return path.Join(n.EnvMountPath, secretFilesSubPath)
+}
+
+func (n injectedNames) templatesMountPath() string {
+	return path.Join(n.EnvMountPath, "templates")
+}
+
+func (n injectedNames) caPath() string {
+	return path.Join(n.TLSMountPath, "ca.pem")
+}
+
+func (n injectedNames) tokenPath() string {
+	return path.Join(n.TokenMountPath, serviceAccountTokenPath)
+}
+
+// resolveInjectedNames picks names prefixed with injected_name_prefix, adding a numeric
+// suffix when the pod already uses a name for something else. Init containers and volumes
+// equal to the ones this webhook renders are reused, this is decided from the spec alone,
+// never from the status annotation which the client can set
+func resolveInjectedNames(podSpec *corev1.PodSpec, vaultConfig VaultConfig) (injectedNames, error) {
+	prefix := viper.GetString("injected_name_prefix")
+	names := injectedNames{
+		EnvMountPath:   path.Clean(viper.GetString("vault_env_mount_path")),
+		TLSMountPath:   path.Clean(viper.GetString("vault_tls_mount_path")),
+		TokenMountPath: path.Clean(viper.GetString("vault_token_mount_path")),
+		AuthMountPath:  path.Clean(viper.GetString("vault_auth_mount_path")),
+	}
+	mountPaths := []string{names.EnvMountPath, names.TLSMountPath, names.TokenMountPath, names.AuthMountPath}
+	for i, a := range mountPaths {
+		for _, b := range mountPaths[i+1:] {
+			if a == b || strings.HasPrefix(b, a+"/") || strings.HasPrefix(a, b+"/") {
+				return names, fmt.Errorf("Error injecting vault-env - mount paths %s and %s overlap", a, b)
+			}
+		}
+	}
+
+	containerNames := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		containerNames[container.Name] = true
+	}
+	volumeNames := map[string]bool{}
+	for _, volume := range podSpec.Volumes {
+		volumeNames[volume.Name] = true
+	}
+
+	var err error
+	if names.EnvVolume, err = freeName(prefix+"env", volumeNames, renderedVolumes(podSpec, getEnvVolume(names))); err != nil {
+		return names, err
+	}
+	volumeNames[names.EnvVolume] = true
+	tlsVolumes := renderedVolumes(podSpec, getTLSVolume(vaultConfig, names))
+	if tlsVolumes[legacyTLSVolume] {
+		names.TLSVolume = legacyTLSVolume
+	} else if names.TLSVolume, err = freeName(prefix+"tls", volumeNames, tlsVolumes); err != nil {
+		return names, err
+	}
+	volumeNames[names.TLSVolume] = true
+	if names.TemplatesVolume, err = freeName(prefix+"templates", volumeNames, renderedVolumes(podSpec, getTemplatesVolume(vaultConfig, names))); err != nil {
+		return names, err
+	}
+	volumeNames[names.TemplatesVolume] = true
+	tokenVolumes := map[string]bool{}
+	if projectsServiceAccountToken(vaultConfig) {
+		tokenVolumes = renderedVolumes(podSpec, getTokenVolume(vaultConfig, names))
+	}
+	if names.TokenVolume, err = freeName(prefix+"token", volumeNames, tokenVolumes); err != nil {
+		return names, err
+	}
+	volumeNames[names.TokenVolume] = true
+	if names.AuthVolume, err = freeName(prefix+"auth", volumeNames, renderedVolumes(podSpec, getAuthVolume(vaultConfig, names))); err != nil {
+		return names, err
+	}
+
+	envInitContainers := renderedInitContainers(podSpec, getEnvInitContainer(names))
+	if envInitContainers[legacyInitContainer] {
+		names.InitContainer = legacyInitContainer
+	} else if names.InitContainer, err = freeName(prefix+"init", containerNames, envInitContainers); err != nil {
+		return names, err
+	}
+	containerNames[names.InitContainer] = true
+	filesContainer := corev1.Container{Image: viper.GetString("vault_env_image"), Command: []string{vaultEnvImageBinary}}
+	if names.FilesInitContainer, err = freeName(prefix+"files", containerNames, renderedInitContainers(podSpec, filesContainer)); err != nil {
+		return names, err
+	}
+	return names, nil
+}
+
+// renderedVolumes returns the names of the volumes of the pod with the source of rendered,
+// ignoring the default mode the API server sets
+func renderedVolumes(podSpec *corev1.PodSpec, rendered corev1.Volume) map[string]bool {
+	matches := map[string]bool{}
+	for _, volume := range podSpec.Volumes {
+		if equality.Semantic.DeepEqual(withoutDefaultMode(volume.VolumeSource), withoutDefaultMode(rendered.VolumeSource)) {
+			matches[volume.Name] = true
+		}
+	}
+	return matches
+}
+
+func withoutDefaultMode(source corev1.VolumeSource) corev1.VolumeSource {
+	source = *source.DeepCopy()
+	if source.Secret != nil {
+		source.Secret.DefaultMode = nil
+	}
+	if source.ConfigMap != nil {
+		source.ConfigMap.DefaultMode = nil
+	}
+	if source.Projected != nil {
+		source.Projected.DefaultMode = nil
+	}
+	return source
+}
+
+// renderedInitContainers returns the names of the init containers of the pod running the
+// image and command of rendered, they are replaced with the rendered container
+func renderedInitContainers(podSpec *corev1.PodSpec, rendered corev1.Container) map[string]bool {
+	matches := map[string]bool{}
+	for _, container := range podSpec.InitContainers {
+		if container.Image == rendered.Image && equality.Semantic.DeepEqual(container.Command, rendered.Command) {
+			matches[container.Name] = true
+		}
+	}
+	return matches
+}
+
+// freeName returns name or name-<n>, the first one that is unused or owned by the injection
+func freeName(name string, used map[string]bool, owned map[string]bool) (string, error) {
+	for i := 0; i <= maxNameSuffix; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d", name, i)
+		}
+		if !used[candidate] || owned[candidate] {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("Error injecting vault-env - no free name for %s, the pod already uses %s to %s-%d", name, name, name, maxNameSuffix)
+}
+
+// checkMountConflicts rejects containers that already mount something else at the injected paths
+func checkMountConflicts(container corev1.Container, names injectedNames) error {
+	injected := map[string]string{
+		names.EnvMountPath:   names.EnvVolume,
+		names.TLSMountPath:   names.TLSVolume,
+		names.TokenMountPath: names.TokenVolume,
+		names.AuthMountPath:  names.AuthVolume,
+	}
+	for _, volumeMount := range container.VolumeMounts {
+		mountPath := path.Clean(volumeMount.MountPath)
+		if volume, ok := injected[mountPath]; ok && volume != volumeMount.Name {
+			return fmt.Errorf("Error injecting vault-env - container %s already mounts volume %s at %s, change the mount path of the container or the webhook's vault_env_mount_path/vault_tls_mount_path/vault_token_mount_path/vault_auth_mount_path", container.Name, volumeMount.Name, mountPath)
+		}
+	}
+	return nil
+}
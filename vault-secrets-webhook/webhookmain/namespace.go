@@ -0,0 +1,82 @@
+package webhookmain
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// namespaceSyncTimeout bounds the wait for the initial list of namespaces
+const namespaceSyncTimeout = 30 * time.Second
+
+// namespaceDefaults are the annotations pods inherit from their namespace, annotations that
+// enable injection or add secrets to the pod must be set on the pod itself
+var namespaceDefaults = []string{
+	"vault.security/vault-addr",
+	"vault.security/vault-role",
+	"vault.security/vault-path",
+	"vault.security/vault-auth-path",
+	"vault.security/vault-auth-method",
+	"vault.security/vault-namespace",
+	"vault.security/vault-tls-secret-name",
+}
+
+// namespaceLister serves namespaces from the informer cache, nil when no informer runs
+var namespaceLister corelisters.NamespaceLister
+
+// StartNamespaceInformer caches namespaces so their vault.security/* annotations
+// can be used as defaults without an API call per admission request
+func StartNamespaceInformer(client kubernetes.Interface, stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	lister := factory.Core().V1().Namespaces().Lister()
+
+	factory.Start(stopCh)
+
+	// give up waiting for the sync after the timeout, the informer keeps running until stopCh is closed
+	syncCh := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(syncCh)
+		select {
+		case <-stopCh:
+		case <-done:
+		case <-time.After(namespaceSyncTimeout):
+		}
+	}()
+	for informer, synced := range factory.WaitForCacheSync(syncCh) {
+		if !synced {
+			return fmt.Errorf("failed to sync %s informer within %s", informer, namespaceSyncTimeout)
+		}
+	}
+
+	namespaceLister = lister
+	return nil
+}
+
+// mergeNamespaceAnnotations returns the namespaceDefaults annotations of the namespace
+// overridden by the given pod annotations
+func mergeNamespaceAnnotations(namespace string, annotations map[string]string) map[string]string {
+	if namespaceLister == nil || namespace == "" {
+		return annotations
+	}
+
+	ns, err := namespaceLister.Get(namespace)
+	if err != nil {
+		return annotations
+	}
+
+	merged := map[string]string{}
+	for _, key := range namespaceDefaults {
+		if value, ok := ns.GetAnnotations()[key]; ok {
+			merged[key] = value
+		}
+	}
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,466 @@
+package webhookmain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy restricts the vault roles and paths pods may use, a pod is allowed when a rule
+// matching its namespace and service account allows its role and every path it reads
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+
+	// rules are the Rules with their patterns compiled
+	rules []policyRule
+}
+
+// PolicyRule patterns are globs where * matches any characters but /, ** matches any characters
+// including / and ? matches one character but /, <namespace> and <serviceaccount> are replaced
+// with those of the pod
+type PolicyRule struct {
+	// Namespaces and ServiceAccounts the rule applies to, empty matches all
+	Namespaces      []string `json:"namespaces"`
+	ServiceAccounts []string `json:"serviceAccounts"`
+	// Roles and Paths allowed by the rule, paths are matched without a leading /
+	Roles []string `json:"roles"`
+	Paths []string `json:"paths"`
+}
+
+type policyRule struct {
+	namespaces      []glob
+	serviceAccounts []glob
+	roles           []glob
+	paths           []glob
+}
+
+// policy is enforced by VaultSecretsMutator, nil allows every role and path
+var policy *Policy
+
+// SetPolicy set the policy enforced on mutated pods
+func SetPolicy(p *Policy) {
+	if p != nil {
+		p.compile()
+	}
+	policy = p
+}
+
+// LoadPolicy reads a policy from a YAML or JSON file, an empty file name returns a nil policy.
+// The policy is only read at startup, the webhook must be restarted to apply changes
+func LoadPolicy(file string) (*Policy, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %s", err)
+	}
+
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %s", file, err)
+	}
+	p.compile()
+	return &p, nil
+}
+
+// compile parses the patterns of the rules once instead of on every admission request
+func (p *Policy) compile() {
+	if len(p.rules) == len(p.Rules) {
+		return
+	}
+	p.rules = make([]policyRule, 0, len(p.Rules))
+	for _, rule := range p.Rules {
+		p.rules = append(p.rules, policyRule{
+			namespaces:      compileGlobs(rule.Namespaces, false),
+			serviceAccounts: compileGlobs(rule.ServiceAccounts, false),
+			roles:           compileGlobs(rule.Roles, false),
+			paths:           compileGlobs(rule.Paths, true),
+		})
+	}
+}
+
+// policyMatch holds the rules applying to a pod
+type policyMatch struct {
+	namespace      string
+	serviceAccount string
+	rules          []policyRule
+}
+
+func (p *Policy) match(namespace, serviceAccount string) *policyMatch {
+	m := &policyMatch{namespace: namespace, serviceAccount: serviceAccount}
+	for _, rule := range p.rules {
+		if matchesAny(rule.namespaces, namespace, m) && matchesAny(rule.serviceAccounts, serviceAccount, m) {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	return m
+}
+
+func (m *policyMatch) allowsRole(role string) bool {
+	for _, rule := range m.rules {
+		if len(rule.roles) > 0 && matchesAny(rule.roles, role, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *policyMatch) allowsPath(path string) bool {
+	path = strings.TrimPrefix(path, "/")
+	for _, rule := range m.rules {
+		for _, pattern := range rule.paths {
+			if pattern.match(path, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether value matches one of patterns, no patterns match everything
+func matchesAny(patterns []glob, value string, m *policyMatch) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.match(value, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// glob is a compiled policy pattern, the <namespace> and <serviceaccount> placeholders
+// are kept as parts of their own and replaced with those of the pod when matching
+type glob []globPart
+
+type globPart struct {
+	// wildcard is *, **, ?, <namespace> or <serviceaccount>, empty for literal text
+	wildcard string
+	text     string
+}
+
+const (
+	namespacePlaceholder      = "<namespace>"
+	serviceAccountPlaceholder = "<serviceaccount>"
+)
+
+func compileGlobs(patterns []string, trimSlash bool) []glob {
+	globs := make([]glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		if trimSlash {
+			pattern = strings.TrimPrefix(pattern, "/")
+		}
+		globs = append(globs, compileGlob(pattern))
+	}
+	return globs
+}
+
+func compileGlob(pattern string) glob {
+	var g glob
+	var text strings.Builder
+	addWildcard := func(wildcard string) {
+		if text.Len() > 0 {
+			g = append(g, globPart{text: text.String()})
+			text.Reset()
+		}
+		g = append(g, globPart{wildcard: wildcard})
+	}
+	for len(pattern) > 0 {
+		switch {
+		case strings.HasPrefix(pattern, namespacePlaceholder):
+			addWildcard(namespacePlaceholder)
+			pattern = pattern[len(namespacePlaceholder):]
+		case strings.HasPrefix(pattern, serviceAccountPlaceholder):
+			addWildcard(serviceAccountPlaceholder)
+			pattern = pattern[len(serviceAccountPlaceholder):]
+		case pattern[0] == '*':
+			// two or more stars cross segments
+			stars := len(pattern) - len(strings.TrimLeft(pattern, "*"))
+			wildcard := "*"
+			if stars > 1 {
+				wildcard = "**"
+			}
+			addWildcard(wildcard)
+			pattern = pattern[stars:]
+		case pattern[0] == '?':
+			addWildcard("?")
+			pattern = pattern[1:]
+		default:
+			r, size := utf8.DecodeRuneInString(pattern)
+			text.WriteRune(r)
+			pattern = pattern[size:]
+		}
+	}
+	if text.Len() > 0 {
+		g = append(g, globPart{text: text.String()})
+	}
+	return g
+}
+
+// match reports whether the whole value matches the glob, * backtracks to the shortest
+// match first
+func (g glob) match(value string, m *policyMatch) bool {
+	if len(g) == 0 {
+		return value == ""
+	}
+
+	part := g[0]
+	switch part.wildcard {
+	case "*", "**":
+		for i := range value {
+			if g[1:].match(value[i:], m) {
+				return true
+			}
+			if value[i] == '/' && part.wildcard == "*" {
+				return false
+			}
+		}
+		return g[1:].match("", m)
+	case "?":
+		if value == "" || value[0] == '/' {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(value)
+		return g[1:].match(value[size:], m)
+	case namespacePlaceholder:
+		part.text = m.namespace
+	case serviceAccountPlaceholder:
+		part.text = m.serviceAccount
+	}
+	return strings.HasPrefix(value, part.text) && g[1:].match(value[len(part.text):], m)
+}
+
+// authorizePolicy checks the role and every vault path the pod reads, through its env,
+// secret files and templates, against the policy and returns them, nil without a policy
+func authorizePolicy(podSpec *corev1.PodSpec, vaultConfig VaultConfig, sources *envSources, ns string) ([]string, error) {
+	if policy == nil {
+		return nil, nil
+	}
+
+	serviceAccount := podSpec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	m := policy.match(ns, serviceAccount)
+
+	// approle, cert and token logins carry their identity in credentials the webhook can't see
+	if vaultConfig.Role != "" && !m.allowsRole(vaultConfig.Role) {
+		return nil, reject("policy_denied", fmt.Errorf("Error authorizing vault role %q - the webhook policy doesn't allow it for service account %s/%s", vaultConfig.Role, ns, serviceAccount))
+	}
+
+	paths, err := vaultPaths(podSpec, vaultConfig, sources)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		// a path like secret/data/team-x/../team-y would pass for one of team-x
+		if err := validatePolicyPath(path); err != nil {
+			return nil, reject("policy_denied", err)
+		}
+		if !m.allowsPath(path) {
+			return nil, reject("policy_denied", fmt.Errorf("Error authorizing vault path %q - the webhook policy doesn't allow it for service account %s/%s", path, ns, serviceAccount))
+		}
+	}
+	return paths, nil
+}
+
+// namespaceRefSuffix makes vault-env read a reference from a child of the pod's Vault
+// namespace, e.g. vault:secret/data/app#password?namespace=shared
+const namespaceRefSuffix = "?namespace="
+
+// vaultPaths returns the sorted vault paths read by the pod without leading or trailing /,
+// prefixed with the Vault namespace of the pod as <namespace>/<path>, the namespace of a
+// ?namespace=<namespace> reference is joined onto it
+func vaultPaths(podSpec *corev1.PodSpec, vaultConfig VaultConfig, sources *envSources) ([]string, error) {
+	paths := map[string]bool{}
+	addPath := func(path string) {
+		paths[strings.Trim(path, "/")] = true
+	}
+	if vaultConfig.Path != "" {
+		addPath(namespacedPath(vaultConfig.VaultNamespace, vaultConfig.Path))
+	}
+
+	addReference := func(ref string) error {
+		namespace := ""
+		if i := strings.Index(ref, namespaceRefSuffix); i >= 0 {
+			namespace = strings.Trim(ref[i+len(namespaceRefSuffix):], "/")
+			ref = ref[:i]
+			// a namespace like ../team-b would escape the one of the pod
+			if err := validateVaultNamespace(namespace); err != nil {
+				return reject("invalid_vault_namespace", err)
+			}
+		}
+		path := vaultConfig.Path
+		if split := strings.SplitN(ref, "#", 2); len(split) == 2 {
+			path = split[0]
+		}
+		if path == "" {
+			return nil
+		}
+		addPath(namespacedPath(namespacedPath(vaultConfig.VaultNamespace, namespace), path))
+		return nil
+	}
+	addTemplate := func(name, text string) error {
+		templatePaths, err := templateSecretPaths(name, text)
+		if err != nil {
+			return err
+		}
+		for _, path := range templatePaths {
+			addPath(namespacedPath(vaultConfig.VaultNamespace, path))
+		}
+		return nil
+	}
+
+	for _, ref := range vaultConfig.Files {
+		if err := addReference(ref); err != nil {
+			return nil, err
+		}
+	}
+	for name, text := range vaultConfig.Templates {
+		if err := addTemplate(name, text); err != nil {
+			return nil, err
+		}
+	}
+	if vaultConfig.TemplateConfigMap != "" {
+		templates, err := sources.configMap(vaultConfig.TemplateConfigMap, false)
+		if err != nil {
+			return nil, err
+		}
+		for name, text := range templates {
+			if err := addTemplate(name, text); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, container := range append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		env, err := sources.containerEnv(container)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range env {
+			if strings.HasPrefix(e.Value, templateEnvPrefix) {
+				if err := addTemplate(e.Name, strings.TrimPrefix(e.Value, templateEnvPrefix)); err != nil {
+					return nil, err
+				}
+			} else if strings.HasPrefix(e.Value, "vault:") {
+				if err := addReference(strings.TrimPrefix(e.Value, "vault:")); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// validatePolicyPath rejects paths with empty, . or .. segments, they can't be matched by segment
+func validatePolicyPath(path string) error {
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("Error authorizing vault path %q - paths with empty, . or .. segments are denied by the webhook policy", path)
+		}
+	}
+	return nil
+}
+
+// namespacedPath joins path onto the Vault namespace, an empty namespace returns path unchanged
+func namespacedPath(namespace, path string) string {
+	namespace = strings.Trim(namespace, "/")
+	if namespace == "" {
+		return path
+	}
+	if path = strings.Trim(path, "/"); path == "" {
+		return namespace
+	}
+	return namespace + "/" + path
+}
+
+// templateSecretPaths returns the paths passed to the secret function of a template, paths
+// that are not string literals can't be checked and are denied
+func templateSecretPaths(name, text string) ([]string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing template %q - %s", name, err)
+	}
+
+	var paths []string
+	var walkErr error
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for i, arg := range n.Args {
+				if ident, ok := arg.(*parse.IdentifierNode); ok && ident.Ident == "secret" {
+					if i+1 >= len(n.Args) {
+						walkErr = fmt.Errorf("Error authorizing template %q - the secret path must be a string literal to be checked against the webhook policy", name)
+						continue
+					}
+					path, ok := n.Args[i+1].(*parse.StringNode)
+					if !ok {
+						walkErr = fmt.Errorf("Error authorizing template %q - the secret path must be a string literal to be checked against the webhook policy", name)
+						continue
+					}
+					paths = append(paths, path.Text)
+				}
+				walk(arg)
+			}
+		}
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+	if walkErr != nil {
+		return nil, reject("policy_denied", walkErr)
+	}
+	return paths, nil
+}
@@ -0,0 +1,436 @@
+package webhookmain
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+	// defaultPlatform is picked from manifest lists unless the registry is configured otherwise
+	defaultPlatform = "linux/amd64"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// ImageConfig is the part of an image config vault-env needs to wrap the entrypoint
+type ImageConfig struct {
+	Entrypoint []string
+	Cmd        []string
+}
+
+// RegistryAuth is a registry credential from a docker config pull secret
+type RegistryAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+type cachedImageConfig struct {
+	config  *ImageConfig
+	expires time.Time
+}
+
+// ImageRegistry looks up image configs from Docker and OCI registries
+type ImageRegistry struct {
+	// InsecureRegistries are the registry hosts talked to with plain http, only meant for local registries
+	InsecureRegistries []string
+	// Platform is the os/architecture[/variant] resolved from manifest lists
+	Platform string
+
+	client *http.Client
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedImageConfig
+}
+
+// NewImageRegistry create a registry client with a request timeout and a cache TTL
+func NewImageRegistry(timeout time.Duration, ttl time.Duration) *ImageRegistry {
+	return &ImageRegistry{
+		Platform: defaultPlatform,
+		client:   &http.Client{Timeout: timeout},
+		ttl:      ttl,
+		cache:    map[string]cachedImageConfig{},
+	}
+}
+
+// imageReference is a parsed image name like registry:5000/repo/name:tag
+type imageReference struct {
+	registry   string
+	repository string
+	reference  string
+}
+
+func parseImageReference(image string) imageReference {
+	ref := imageReference{registry: dockerHubRegistry}
+
+	name := image
+	if i := strings.Index(name, "/"); i != -1 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry = normalizeRegistry(host)
+			name = name[i+1:]
+		}
+	}
+
+	if i := strings.Index(name, "@"); i != -1 {
+		ref.reference = name[i+1:]
+		name = name[:i]
+	} else if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		ref.reference = name[i+1:]
+		name = name[:i]
+	} else {
+		ref.reference = "latest"
+	}
+
+	if ref.registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	ref.repository = name
+	return ref
+}
+
+// normalizeRegistry turns docker config keys like https://index.docker.io/v1/ into registry hosts
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	if i := strings.Index(registry, "/"); i != -1 {
+		registry = registry[:i]
+	}
+	switch registry {
+	case "docker.io", "index.docker.io":
+		return dockerHubRegistry
+	}
+	return registry
+}
+
+// GetImageConfig returns the config of image, auths are keyed by registry host
+func (r *ImageRegistry) GetImageConfig(ctx context.Context, image string, auths map[string]RegistryAuth, cacheKey string) (*ImageConfig, error) {
+	key := cacheKey + "/" + image
+
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.config, nil
+	}
+
+	ref := parseImageReference(image)
+	session := &registrySession{registry: r, ref: ref}
+	if auth, ok := auths[ref.registry]; ok {
+		session.auth = &auth
+	}
+
+	config, err := session.imageConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image config of %s: %s", image, err)
+	}
+
+	r.mu.Lock()
+	r.cache[key] = cachedImageConfig{config: config, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return config, nil
+}
+
+// matchesPlatform reports whether a manifest list entry is the configured platform,
+// a platform without a variant matches every variant
+func (r *ImageRegistry) matchesPlatform(os string, architecture string, variant string) bool {
+	platform := strings.Split(r.Platform, "/")
+	if len(platform) < 2 || platform[0] != os || platform[1] != architecture {
+		return false
+	}
+	return len(platform) < 3 || platform[2] == variant
+}
+
+// insecure reports whether registry is talked to with plain http
+func (r *ImageRegistry) insecure(registry string) bool {
+	for _, insecure := range r.InsecureRegistries {
+		if normalizeRegistry(insecure) == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// registrySession holds the credentials and bearer token for one image lookup
+type registrySession struct {
+	registry *ImageRegistry
+	ref      imageReference
+	auth     *RegistryAuth
+	token    string
+}
+
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+func (s *registrySession) imageConfig(ctx context.Context) (*ImageConfig, error) {
+	m, err := s.manifest(ctx, s.ref.reference)
+	if err != nil {
+		return nil, err
+	}
+
+	// resolve manifest lists to the image of the configured platform, falling back to the first one
+	if len(m.Manifests) > 0 {
+		digest := m.Manifests[0].Digest
+		for _, platformManifest := range m.Manifests {
+			platform := platformManifest.Platform
+			if s.registry.matchesPlatform(platform.OS, platform.Architecture, platform.Variant) {
+				digest = platformManifest.Digest
+				break
+			}
+		}
+		m, err = s.manifest(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest has no config")
+	}
+
+	body, err := s.get(ctx, "blobs/"+m.Config.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var blob struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := json.NewDecoder(body).Decode(&blob); err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %s", err)
+	}
+	return &blob.Config, nil
+}
+
+func (s *registrySession) manifest(ctx context.Context, reference string) (*manifest, error) {
+	accept := strings.Join([]string{mediaTypeDockerManifest, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}, ", ")
+	body, err := s.get(ctx, "manifests/"+reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var m manifest
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %s", err)
+	}
+	return &m, nil
+}
+
+// get requests /v2/<repository>/<path>, authenticating on a 401 challenge
+func (s *registrySession) get(ctx context.Context, path string, accept string) (io.ReadCloser, error) {
+	scheme := "https"
+	if s.registry.insecure(s.ref.registry) {
+		scheme = "http"
+	}
+	u := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, s.ref.registry, s.ref.repository, path)
+
+	resp, err := s.do(ctx, u, accept)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && s.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := s.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = s.do(ctx, u, accept); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *registrySession) do(ctx context.Context, u string, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", s.token)
+	}
+	return s.registry.client.Do(req)
+}
+
+// authenticate answers a Basic or Bearer WWW-Authenticate challenge
+func (s *registrySession) authenticate(ctx context.Context, challenge string) error {
+	split := strings.SplitN(challenge, " ", 2)
+	scheme := strings.ToLower(split[0])
+
+	if scheme == "basic" {
+		if s.auth == nil {
+			return fmt.Errorf("registry %s requires credentials, add an imagePullSecret", s.ref.registry)
+		}
+		s.token = "Basic " + s.auth.basic()
+		return nil
+	}
+
+	if scheme != "bearer" || len(split) != 2 {
+		return fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	params := parseChallengeParams(split[1])
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid registry auth realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", s.ref.repository)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if s.auth != nil {
+		req.Header.Set("Authorization", "Basic "+s.auth.basic())
+	}
+
+	resp, err := s.registry.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("registry token request returned %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode registry token: %s", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	s.token = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallengeParams parses realm="...",service="..." pairs
+func parseChallengeParams(params string) map[string]string {
+	result := map[string]string{}
+	for len(params) > 0 {
+		eq := strings.Index(params, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(params[:eq]))
+		params = params[eq+1:]
+
+		var value string
+		if strings.HasPrefix(params, `"`) {
+			end := strings.Index(params[1:], `"`)
+			if end == -1 {
+				value, params = params[1:], ""
+			} else {
+				value, params = params[1:end+1], params[end+2:]
+			}
+		} else if comma := strings.Index(params, ","); comma != -1 {
+			value, params = params[:comma], params[comma:]
+		} else {
+			value, params = params, ""
+		}
+		result[key] = value
+		params = strings.TrimPrefix(strings.TrimSpace(params), ",")
+	}
+	return result
+}
+
+func (a RegistryAuth) basic() string {
+	if a.Auth != "" {
+		return a.Auth
+	}
+	return base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password))
+}
+
+// pullSecretAuths reads the registry credentials of the pod's imagePullSecrets
+func pullSecretAuths(client kubernetes.Interface, namespace string, pullSecrets []corev1.LocalObjectReference) (map[string]RegistryAuth, error) {
+	auths := map[string]RegistryAuth{}
+	if client == nil || len(pullSecrets) == 0 {
+		return auths, nil
+	}
+
+	for _, pullSecret := range pullSecrets {
+		secret, err := client.CoreV1().Secrets(namespace).Get(pullSecret.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get imagePullSecret %s: %s", pullSecret.Name, err)
+		}
+
+		var dockerAuths map[string]RegistryAuth
+		switch secret.Type {
+		case corev1.SecretTypeDockerConfigJson:
+			var config struct {
+				Auths map[string]RegistryAuth `json:"auths"`
+			}
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+				return nil, fmt.Errorf("failed to parse imagePullSecret %s: %s", pullSecret.Name, err)
+			}
+			dockerAuths = config.Auths
+		case corev1.SecretTypeDockercfg:
+			if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &dockerAuths); err != nil {
+				return nil, fmt.Errorf("failed to parse imagePullSecret %s: %s", pullSecret.Name, err)
+			}
+		default:
+			continue
+		}
+
+		for registry, auth := range dockerAuths {
+			auths[normalizeRegistry(registry)] = auth
+		}
+	}
+	return auths, nil
+}
@@ -0,0 +1,372 @@
+package webhookmain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/slok/kubewebhook/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// keys of the certificate Secret, the serving keys match the Secret rendered by the Helm chart
+const (
+	caCertKey      = "caCert"
+	caKeyKey       = "caKey"
+	servingCertKey = "servingCert"
+	servingKeyKey  = "servingKey"
+)
+
+// SelfManagedCertsConfig configures SelfManagedCerts
+type SelfManagedCertsConfig struct {
+	// Namespace and SecretName of the Secret holding the CA and serving key pairs
+	Namespace  string
+	SecretName string
+	// ServiceName is the webhook Service the serving certificate is issued for
+	ServiceName string
+	// WebhookConfigName is the MutatingWebhookConfiguration whose caBundle is patched
+	WebhookConfigName string
+	// CertFile and KeyFile are written for the CertWatcher to serve
+	CertFile string
+	KeyFile  string
+	// Validity of issued certificates, they are re-issued RenewBefore their expiry
+	Validity    time.Duration
+	RenewBefore time.Duration
+}
+
+// SelfManagedCerts keeps a CA and serving certificate in a Secret shared by all webhook replicas
+// and the caBundle of the webhook configuration in sync with it
+type SelfManagedCerts struct {
+	client kubernetes.Interface
+	config SelfManagedCertsConfig
+	logger log.Logger
+}
+
+// NewSelfManagedCerts creates a SelfManagedCerts
+func NewSelfManagedCerts(client kubernetes.Interface, config SelfManagedCertsConfig, logger log.Logger) *SelfManagedCerts {
+	return &SelfManagedCerts{client: client, config: config, logger: logger}
+}
+
+// Run calls Ensure every interval and whenever the Secret changes, so certificates
+// re-issued by another replica are served right away, until stopCh is closed
+func (s *SelfManagedCerts) Run(interval time.Duration, stopCh <-chan struct{}) {
+	changes := make(chan struct{}, 1)
+	s.watchSecret(changes, stopCh)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-changes:
+		case <-stopCh:
+			return
+		}
+		if err := s.Ensure(); err != nil {
+			s.logger.Errorf("error ensuring self-managed certificates: %s", err)
+		}
+	}
+}
+
+// watchSecret notifies changes when the certificate Secret is added or updated
+func (s *SelfManagedCerts) watchSecret(changes chan<- struct{}, stopCh <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.client, 0,
+		informers.WithNamespace(s.config.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.config.SecretName).String()
+		}),
+	)
+
+	notify := func(obj interface{}) {
+		if secret, ok := obj.(*corev1.Secret); ok && secret.Name == s.config.SecretName {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+	})
+	factory.Start(stopCh)
+}
+
+// Ensure loads the key pairs from the Secret, creating or re-issuing them when missing or
+// about to expire, writes the serving key pair to disk and patches the caBundle, a conflict
+// means another replica updated the Secret first and its certificates are used
+func (s *SelfManagedCerts) Ensure() error {
+	var secret *corev1.Secret
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		secret, err = s.ensureSecret()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileIfChanged(s.config.CertFile, secret.Data[servingCertKey]); err != nil {
+		return err
+	}
+	if err := writeFileIfChanged(s.config.KeyFile, secret.Data[servingKeyKey]); err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return s.patchCABundle(secret.Data[caCertKey])
+	})
+}
+
+// ensureSecret returns the certificate Secret, creating or re-issuing the key pairs when needed
+func (s *SelfManagedCerts) ensureSecret() (*corev1.Secret, error) {
+	secrets := s.client.CoreV1().Secrets(s.config.Namespace)
+
+	secret, err := secrets.Get(s.config.SecretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: s.config.SecretName, Namespace: s.config.Namespace},
+			Data:       map[string][]byte{},
+		}
+		if err := s.issue(secret); err != nil {
+			return nil, err
+		}
+		created, err := secrets.Create(secret)
+		if errors.IsAlreadyExists(err) {
+			// another replica won the race, use its certificates
+			created, err = secrets.Get(s.config.SecretName, metav1.GetOptions{})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate secret %s: %s", s.config.SecretName, err)
+		}
+		return created, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get certificate secret %s: %s", s.config.SecretName, err)
+	} else if s.needsIssue(secret) {
+		secret = secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		if err := s.issue(secret); err != nil {
+			return nil, err
+		}
+		updated, err := secrets.Update(secret)
+		if errors.IsConflict(err) {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to update certificate secret %s: %s", s.config.SecretName, err)
+		}
+		return updated, nil
+	}
+	return secret, nil
+}
+
+// needsIssue reports whether the Secret lacks a key pair, e.g. it was rendered by the Helm
+// chart without a CA key, or one of its certificates expires within RenewBefore
+func (s *SelfManagedCerts) needsIssue(secret *corev1.Secret) bool {
+	for _, key := range []string{caCertKey, caKeyKey, servingCertKey, servingKeyKey} {
+		if len(secret.Data[key]) == 0 {
+			return true
+		}
+	}
+
+	for _, key := range []string{caCertKey, servingCertKey} {
+		cert, err := parseCertificatePEM(secret.Data[key])
+		if err != nil || time.Now().Add(s.config.RenewBefore).After(cert.NotAfter) {
+			return true
+		}
+	}
+	return false
+}
+
+// issue re-issues the serving certificate with the current CA, the CA itself is replaced when
+// it is missing or about to expire, the replaced CA stays in caCert until it expires so the
+// API server trusts both during the rotation
+func (s *SelfManagedCerts) issue(secret *corev1.Secret) error {
+	now := time.Now()
+	caCert, caKey, err := parseCAKeyPair(secret.Data[caCertKey], secret.Data[caKeyKey])
+	if err != nil || now.Add(s.config.RenewBefore).After(caCert.NotAfter) {
+		previous := secret.Data[caCertKey]
+
+		// the CA outlives the serving certificates it signs
+		caCert, caKey, err = newCertificate(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: s.config.ServiceName + "-ca"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(2 * s.config.Validity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		caKeyPEM, err := encodeKeyPEM(caKey)
+		if err != nil {
+			return err
+		}
+		bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+		if old, err := parseCertificatePEM(previous); err == nil && now.Before(old.NotAfter) {
+			bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: old.Raw})...)
+		}
+		secret.Data[caCertKey] = bundle
+		secret.Data[caKeyKey] = caKeyPEM
+		s.logger.Infof("issued webhook CA, expires at %s", caCert.NotAfter.Format(time.RFC3339))
+	}
+
+	service := s.config.ServiceName
+	namespace := s.config.Namespace
+	servingCert, servingKey, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", service, namespace)},
+		DNSNames:    []string{service, service + "." + namespace, service + "." + namespace + ".svc", service + "." + namespace + ".svc.cluster.local"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(s.config.Validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	servingKeyPEM, err := encodeKeyPEM(servingKey)
+	if err != nil {
+		return err
+	}
+	secret.Data[servingCertKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingCert.Raw})
+	secret.Data[servingKeyKey] = servingKeyPEM
+	s.logger.Infof("issued webhook serving certificate, expires at %s", servingCert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// patchCABundle sets caBundle on every webhook of the configuration that doesn't have it yet,
+// conflicts are returned as is to be retried
+func (s *SelfManagedCerts) patchCABundle(caBundle []byte) error {
+	configs := s.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	config, err := configs.Get(s.config.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get mutating webhook configuration %s: %s", s.config.WebhookConfigName, err)
+	}
+
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			config.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if _, err := configs.Update(config); errors.IsConflict(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to patch caBundle of mutating webhook configuration %s: %s", s.config.WebhookConfigName, err)
+	}
+	s.logger.Infof("patched caBundle of mutating webhook configuration %s", s.config.WebhookConfigName)
+	return nil
+}
+
+// newCertificate signs template with parent, a nil parent self-signs it
+func newCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func encodeKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseCertificatePEM parses the first certificate of data
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseCAKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no CA key found")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// writeFileIfChanged atomically replaces file with data, unchanged files are left alone so
+// the CertWatcher only reloads on real changes
+func writeFileIfChanged(file string, data []byte) error {
+	if current, err := ioutil.ReadFile(file); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
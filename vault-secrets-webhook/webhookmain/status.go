@@ -0,0 +1,146 @@
+package webhookmain
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// injectionStatusAnnotation records what was injected into the pod spec
+	injectionStatusAnnotation = "vault.security/status"
+	// injectionVersion is bumped when the injected layout changes, version 1 named
+	// the init container init and the TLS volume tls, version 2 projected the service
+	// account token unless disabled
+	injectionVersion = "3"
+)
+
+// injectionStatus is stored as JSON in the vault.security/status annotation
+type injectionStatus struct {
+	Version        string   `json:"version"`
+	Containers     []string `json:"containers"`
+	InitContainers []string `json:"initContainers"`
+	Volumes        []string `json:"volumes"`
+}
+
+func setInjectionStatus(obj metav1.Object, status injectionStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[injectionStatusAnnotation] = string(value)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// isWrapped reports whether the container command was already replaced by vault-env
+func isWrapped(container corev1.Container, names injectedNames) bool {
+	return len(container.Command) > 0 && container.Command[0] == names.vaultEnvBinary()
+}
+
+// containerIndex returns the index of the container with name or -1
+func containerIndex(containers []corev1.Container, name string) int {
+	for i, container := range containers {
+		if container.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// managedEnvVars are the env vars vault-env is configured with, the webhook owns them in the
+// containers it wraps and removes the ones it doesn't render
+var managedEnvVars = map[string]bool{
+	"VAULT_ADDR":           true,
+	"VAULT_ADDR_ALLOWLIST": true,
+	"VAULT_ALLOWED_PATHS":  true,
+	"VAULT_PATH":           true,
+	"VAULT_ROLE":           true,
+	"VAULT_CAPATH":         true,
+	"VAULT_AUTH_PATH":      true,
+	"VAULT_AUTH_METHOD":    true,
+	"VAULT_NAMESPACE":      true,
+	"VAULT_SA_TOKEN_FILE":  true,
+	"VAULT_ROLE_ID_FILE":   true,
+	"VAULT_SECRET_ID_FILE": true,
+	"VAULT_TOKEN_FILE":     true,
+	"VAULT_JWT_FILE":       true,
+	"VAULT_CLIENT_CERT":    true,
+	"VAULT_CLIENT_KEY":     true,
+	"VAULT_ENV_LOG_FORMAT": true,
+	"VAULT_ENV_LOG_LEVEL":  true,
+	"VAULT_ENV_SUPERVISE":  true,
+	"VAULT_WATCH_INTERVAL": true,
+	"VAULT_WATCH_ACTION":   true,
+	"VAULT_WATCH_SIGNAL":   true,
+	"VAULT_FILES":          true,
+	"VAULT_FILES_DIR":      true,
+	"VAULT_FILES_MODE":     true,
+	"VAULT_FILES_OWNER":    true,
+	"VAULT_TEMPLATES":      true,
+	"VAULT_TEMPLATES_DIR":  true,
+}
+
+// mergeEnvVars sets the injected env vars, whatever the pod set them to, and drops the
+// managed env vars that aren't injected, e.g. a VAULT_AUTH_PATH sent with the pod
+func mergeEnvVars(envVars []corev1.EnvVar, injected []corev1.EnvVar) []corev1.EnvVar {
+	injectedNames := map[string]bool{}
+	for _, env := range injected {
+		injectedNames[env.Name] = true
+	}
+
+	var merged []corev1.EnvVar
+	for _, env := range envVars {
+		if managedEnvVars[env.Name] && !injectedNames[env.Name] {
+			continue
+		}
+		merged = append(merged, env)
+	}
+
+	for _, env := range injected {
+		exists := false
+		for i := range merged {
+			if merged[i].Name == env.Name {
+				merged[i] = env
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			merged = append(merged, env)
+		}
+	}
+	return merged
+}
+
+// mergeVolumeMounts appends the injected volume mounts that are not mounted yet
+func mergeVolumeMounts(volumeMounts []corev1.VolumeMount, injected []corev1.VolumeMount) []corev1.VolumeMount {
+	for _, mount := range injected {
+		exists := false
+		for _, volumeMount := range volumeMounts {
+			if volumeMount.Name == mount.Name && volumeMount.MountPath == mount.MountPath {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			volumeMounts = append(volumeMounts, mount)
+		}
+	}
+	return volumeMounts
+}
@@ -0,0 +1,85 @@
+package webhookmain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	templateAnnotationPrefix = "vault.security/template."
+	// env values starting with vault-template: are rendered by vault-env
+	templateEnvPrefix = "vault-template:"
+)
+
+// templateFuncs mirrors the helpers vault-env provides so templates can be
+// validated at admission time, vault-env's template_test.go checks the names match
+var templateFuncs = template.FuncMap{
+	"secret":    func(string) (map[string]interface{}, error) { return nil, nil },
+	"b64enc":    func(interface{}) string { return "" },
+	"b64dec":    func(interface{}) (string, error) { return "", nil },
+	"toJSON":    func(interface{}) (string, error) { return "", nil },
+	"fromJSON":  func(interface{}) (interface{}, error) { return nil, nil },
+	"pemEncode": func(string, interface{}) string { return "" },
+	"pemDecode": func(interface{}) (string, error) { return "", nil },
+}
+
+// parseTemplates collects the vault.security/template.<name>: <template> annotations
+func parseTemplates(annotations map[string]string) map[string]string {
+	templates := map[string]string{}
+	for annotation, text := range annotations {
+		if strings.HasPrefix(annotation, templateAnnotationPrefix) {
+			templates[strings.TrimPrefix(annotation, templateAnnotationPrefix)] = text
+		}
+	}
+	return templates
+}
+
+func validateTemplate(name string, text string) error {
+	if _, err := template.New(name).Funcs(templateFuncs).Parse(text); err != nil {
+		return fmt.Errorf("Error parsing template %q - %s", name, err)
+	}
+	return nil
+}
+
+func validateTemplates(vaultConfig VaultConfig) error {
+	for name, text := range vaultConfig.Templates {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("Error parsing template %q - \"%s<name>\" must be a plain file name", name, templateAnnotationPrefix)
+		}
+		if _, ok := vaultConfig.Files[name]; ok {
+			return fmt.Errorf("Error parsing template %q - a secret file with the same name exists", name)
+		}
+		if err := validateTemplate(name, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templatesEnv transforms the template annotations to env vars for vault-env execution
+func templatesEnv(vaultConfig VaultConfig, names injectedNames) ([]corev1.EnvVar, error) {
+	var envVars []corev1.EnvVar
+
+	if len(vaultConfig.Templates) > 0 {
+		templates, err := json.Marshal(vaultConfig.Templates)
+		if err != nil {
+			return nil, err
+		}
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  "VAULT_TEMPLATES",
+			Value: string(templates),
+		})
+	}
+
+	if vaultConfig.TemplateConfigMap != "" {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  "VAULT_TEMPLATES_DIR",
+			Value: names.templatesMountPath(),
+		})
+	}
+	return envVars, nil
+}
@@ -0,0 +1,104 @@
+package webhookmain
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// serviceAccountTokenPath is the file of the projected token in its volume
+	serviceAccountTokenPath = "token"
+	// minTokenExpiration is the shortest expiration the API server issues tokens for
+	minTokenExpiration = 10 * time.Minute
+)
+
+// usesServiceAccountToken reports whether vault-env logs in to method with a service account token
+func usesServiceAccountToken(method string) bool {
+	return isKubernetesAuth(method) || method == "jwt"
+}
+
+// projectsServiceAccountToken reports whether a short lived token bound to the Vault audience
+// is mounted for the login instead of the legacy auto-mounted token, it is always mounted
+// when the pod or its service account set automountServiceAccountToken: false
+func projectsServiceAccountToken(vaultConfig VaultConfig) bool {
+	return vaultConfig.TokenProjection && usesServiceAccountToken(vaultConfig.AuthMethod)
+}
+
+// projectTokenWithoutAutomount projects the token when the pod or its service account disable
+// automountServiceAccountToken, vault-env would have no token to log in with otherwise
+func projectTokenWithoutAutomount(vaultConfig *VaultConfig, podSpec *corev1.PodSpec, ns string) error {
+	if vaultConfig.TokenProjection || !usesServiceAccountToken(vaultConfig.AuthMethod) || vaultConfig.JWTFile != "" {
+		return nil
+	}
+	automount, err := automountsServiceAccountToken(podSpec, ns)
+	if err != nil {
+		return err
+	}
+	vaultConfig.TokenProjection = !automount
+	return nil
+}
+
+// automountsServiceAccountToken reports whether the service account token is mounted into the
+// pod, the setting of the pod takes precedence over the one of its service account
+func automountsServiceAccountToken(podSpec *corev1.PodSpec, ns string) (bool, error) {
+	if podSpec.AutomountServiceAccountToken != nil {
+		return *podSpec.AutomountServiceAccountToken, nil
+	}
+	if kubeClient == nil {
+		return true, nil
+	}
+
+	name := podSpec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	serviceAccount, err := kubeClient.CoreV1().ServiceAccounts(ns).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// the API server rejects pods of missing service accounts
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Error reading service account %s/%s - %s", ns, name, err)
+	}
+	return serviceAccount.AutomountServiceAccountToken == nil || *serviceAccount.AutomountServiceAccountToken, nil
+}
+
+func validateServiceAccountToken(vaultConfig VaultConfig) error {
+	if !projectsServiceAccountToken(vaultConfig) {
+		return nil
+	}
+	if vaultConfig.TokenAudience == "" {
+		return fmt.Errorf("Error getting service account token audience - set the annotation \"vault.security/service-account-token-audience\"")
+	}
+	if expiration, err := time.ParseDuration(vaultConfig.TokenExpiration); err != nil || expiration < minTokenExpiration {
+		return fmt.Errorf("Error parsing service account token expiration %q - \"vault.security/service-account-token-expiration\" must be a duration of at least %s", vaultConfig.TokenExpiration, minTokenExpiration)
+	}
+	return nil
+}
+
+func getTokenVolume(vaultConfig VaultConfig, names injectedNames) corev1.Volume {
+	// validated by validateServiceAccountToken
+	expiration, _ := time.ParseDuration(vaultConfig.TokenExpiration)
+	expirationSeconds := int64(expiration.Seconds())
+
+	return corev1.Volume{
+		Name: names.TokenVolume,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          vaultConfig.TokenAudience,
+							ExpirationSeconds: &expirationSeconds,
+							Path:              serviceAccountTokenPath,
+						},
+					},
+				},
+			},
+		},
+	}
+}
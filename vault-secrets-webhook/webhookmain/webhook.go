@@ -3,18 +3,26 @@ package webhookmain
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	whhttp "github.com/slok/kubewebhook/pkg/http"
 	"github.com/slok/kubewebhook/pkg/log"
+	"github.com/slok/kubewebhook/pkg/observability/metrics"
 	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	"github.com/slok/kubewebhook/pkg/webhook/mutating"
 
 	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -23,11 +31,61 @@ import (
 
 // VaultConfig type
 type VaultConfig struct {
-	Addr          string
-	Role          string
-	Path          string
+	Addr     string
+	Role     string
+	Path     string
+	AuthPath string
+	// AuthMethod is the vault-env auth method, kubernetes if empty
+	AuthMethod    string
 	Enabled       bool
 	TLSSecretName string
+	Supervise     bool
+	WatchInterval string
+	WatchAction   string
+	WatchSignal   string
+	Files         map[string]string
+	FileMountPath string
+	FileMode      string
+	FileOwner     string
+	Templates     map[string]string
+	// TemplateConfigMap holds file templates, rendered next to the secret files
+	TemplateConfigMap string
+	// TokenProjection mounts a projected service account token with TokenAudience and
+	// TokenExpiration for the Vault login
+	TokenProjection bool
+	TokenAudience   string
+	TokenExpiration string
+	// VaultNamespace is the Vault Enterprise namespace of the login and the reads, the root namespace if empty
+	VaultNamespace string
+	// AuthSecretName holds the login credentials of the approle, token, jwt and cert auth methods,
+	// the credential files below are keys of it when relative
+	AuthSecretName string
+	RoleIDFile     string
+	SecretIDFile   string
+	TokenFile      string
+	JWTFile        string
+	ClientCertFile string
+	ClientKeyFile  string
+	// AllowedPaths are the paths authorized by the webhook policy as <vault namespace>/<path>,
+	// vault-env reads no others, nil without a policy
+	AllowedPaths []string
+}
+
+var (
+	// kubeClient reads cluster objects needed for the mutation, nil when running outside a cluster
+	kubeClient kubernetes.Interface
+	// imageRegistry resolves the entrypoint of containers without a command
+	imageRegistry *ImageRegistry
+)
+
+// SetKubernetesClient set the client used to read cluster objects
+func SetKubernetesClient(client kubernetes.Interface) {
+	kubeClient = client
+}
+
+// SetImageRegistry set the registry client used to resolve image entrypoints
+func SetImageRegistry(registry *ImageRegistry) {
+	imageRegistry = registry
 }
 
 // Kubernetes client set
@@ -44,179 +102,610 @@ func newClientSet() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-func getVolumes(vaultConfig VaultConfig) []corev1.Volume {
-	volumes := []corev1.Volume{
-		{
-			Name: "vault-env",
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{
-					Medium: corev1.StorageMediumMemory,
-				},
+func getVolumes(vaultConfig VaultConfig, names injectedNames) []corev1.Volume {
+	volumes := []corev1.Volume{getEnvVolume(names), getTLSVolume(vaultConfig, names)}
+
+	if projectsServiceAccountToken(vaultConfig) {
+		volumes = append(volumes, getTokenVolume(vaultConfig, names))
+	}
+
+	if vaultConfig.AuthSecretName != "" {
+		volumes = append(volumes, getAuthVolume(vaultConfig, names))
+	}
+
+	if vaultConfig.TemplateConfigMap != "" {
+		volumes = append(volumes, getTemplatesVolume(vaultConfig, names))
+	}
+	return volumes
+}
+
+func getEnvVolume(names injectedNames) corev1.Volume {
+	return corev1.Volume{
+		Name: names.EnvVolume,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium: corev1.StorageMediumMemory,
 			},
-		}, {
-			Name: "tls",
-			VolumeSource: corev1.VolumeSource{
-				Secret: &corev1.SecretVolumeSource{
-					SecretName: vaultConfig.TLSSecretName,
+		},
+	}
+}
+
+func getTLSVolume(vaultConfig VaultConfig, names injectedNames) corev1.Volume {
+	return corev1.Volume{
+		Name: names.TLSVolume,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: vaultConfig.TLSSecretName,
+			},
+		},
+	}
+}
+
+func getTemplatesVolume(vaultConfig VaultConfig, names injectedNames) corev1.Volume {
+	return corev1.Volume{
+		Name: names.TemplatesVolume,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: vaultConfig.TemplateConfigMap,
 				},
 			},
 		},
 	}
-	return volumes
 }
 
-func getInitContainers(vaultConfig VaultConfig) []corev1.Container {
-	containers := []corev1.Container{}
+func getInitContainers(vaultConfig VaultConfig, names injectedNames) ([]corev1.Container, error) {
+	containers := []corev1.Container{getEnvInitContainer(names)}
 
-	containers = append(containers, corev1.Container{
-		Name:            "init",
+	if hasSecretFiles(vaultConfig) {
+		filesContainer, err := getSecretFilesContainer(vaultConfig, names)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, filesContainer)
+	}
+	return containers, nil
+}
+
+// getEnvInitContainer copies the vault-env binary to the vault-env volume
+func getEnvInitContainer(names injectedNames) corev1.Container {
+	return corev1.Container{
+		Name:            names.InitContainer,
 		Image:           viper.GetString("vault_env_image"),
 		ImagePullPolicy: corev1.PullIfNotPresent,
-		Command:         []string{"sh", "-c", "cp /usr/local/bin/vault-env /vault/"},
+		Command:         []string{"sh", "-c", "cp " + vaultEnvImageBinary + " " + names.EnvMountPath + "/"},
 		VolumeMounts: []corev1.VolumeMount{
 			{
-				Name:      "vault-env",
-				MountPath: "/vault",
+				Name:      names.EnvVolume,
+				MountPath: names.EnvMountPath,
 			},
 		},
-	})
-	return containers
+	}
+}
+
+// getImageConfig looks up the image config using the pod's imagePullSecrets
+func getImageConfig(ctx context.Context, image string, podSpec *corev1.PodSpec, ns string) (*ImageConfig, error) {
+	auths, err := pullSecretAuths(kubeClient, ns, podSpec.ImagePullSecrets)
+	if err != nil {
+		return nil, err
+	}
+	return imageRegistry.GetImageConfig(ctx, image, auths, ns)
 }
 
-func mutateContainers(containers []corev1.Container, vaultConfig VaultConfig, ns string) (bool, error) {
-	mutated := false
+// mutateContainers wraps the containers using vault secrets with vault-env and
+// returns their names, containers already wrapped are reconciled in place
+func mutateContainers(ctx context.Context, containers []corev1.Container, podSpec *corev1.PodSpec, vaultConfig VaultConfig, names injectedNames, sources *envSources, ns string) ([]string, error) {
+	var mutated []string
 	for i, container := range containers {
 		var envVars []corev1.EnvVar
 
-		for _, env := range container.Env {
-			if strings.HasPrefix(env.Value, "vault:") {
+		// vault-env resolves the values at runtime no matter where they come from
+		containerEnv, err := sources.containerEnv(container)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, env := range containerEnv {
+			if strings.HasPrefix(env.Value, templateEnvPrefix) {
+				if err := validateTemplate(env.Name, strings.TrimPrefix(env.Value, templateEnvPrefix)); err != nil {
+					return nil, err
+				}
+				envVars = append(envVars, env)
+			} else if strings.HasPrefix(env.Value, "vault:") {
+				// vault:<key> is read from the pod's vault path, vault:<path>#<key> carries its own
+				if vaultConfig.Path == "" && !strings.Contains(env.Value, "#") {
+					return nil, reject("missing_vault_path", fmt.Errorf("Error getting vault path for env %s in container %s - set the annotation \"vault.security/vault-path\" or use the form vault:<path>#<key>", env.Name, container.Name))
+				}
 				envVars = append(envVars, env)
 			}
 		}
 
-		if len(envVars) == 0 {
+		// the files init container writes the secret files once, the other containers only mount them
+		refreshesFiles := refreshesSecretFiles(container, podSpec, vaultConfig)
+		if len(envVars) == 0 && !refreshesFiles {
+			if hasSecretFiles(vaultConfig) {
+				if err := checkMountConflicts(container, names); err != nil {
+					return nil, reject("injection_conflict", err)
+				}
+				container.VolumeMounts = mergeVolumeMounts(container.VolumeMounts, secretFilesMounts(vaultConfig, names))
+				containers[i] = container
+			}
 			continue
 		}
 
-		mutated = true
+		if err := checkMountConflicts(container, names); err != nil {
+			return nil, reject("injection_conflict", err)
+		}
 
-		// add args to command list; cmd arg arg
-		args := append(container.Command, container.Args...)
+		mutated = append(mutated, container.Name)
+
+		// containers already wrapped, e.g. in pods created from a mutated workload template, keep their command
+		if !isWrapped(container, names) {
+			command, args := container.Command, container.Args
+			if len(command) == 0 {
+				// the container relies on the image ENTRYPOINT and CMD
+				imageConfig, err := getImageConfig(ctx, container.Image, podSpec, ns)
+				if err != nil {
+					return nil, fmt.Errorf("Error resolving the entrypoint of container %s - set its command explicitly: %s", container.Name, err)
+				}
+				command = imageConfig.Entrypoint
+				if len(args) == 0 {
+					args = imageConfig.Cmd
+				}
+				if len(command) == 0 && len(args) == 0 {
+					return nil, fmt.Errorf("Error resolving the entrypoint of container %s - image %s has no ENTRYPOINT or CMD", container.Name, container.Image)
+				}
+			}
 
-		container.Command = []string{"/vault/vault-env"}
-		container.Args = args
+			// add args to command list; cmd arg arg
+			container.Command = []string{names.vaultEnvBinary()}
+			container.Args = append(append([]string{}, command...), args...)
+		}
 
 		// add the volume mount for vault-env
-		container.VolumeMounts = append(container.VolumeMounts, []corev1.VolumeMount{
+		env, volumeMounts := vaultEnvConfig(vaultConfig, names)
+		volumeMounts = append([]corev1.VolumeMount{
 			{
-				Name:      "vault-env",
-				MountPath: "/vault",
-			}, {
-				Name:      "tls",
-				MountPath: "/etc/tls",
+				Name:      names.EnvVolume,
+				MountPath: names.EnvMountPath,
 			},
-		}...)
+		}, volumeMounts...)
 
-		// transform pod annotations to env vars for vault-env execution
-		container.Env = append(container.Env, []corev1.EnvVar{
-			{
-				Name:  "VAULT_ADDR",
-				Value: vaultConfig.Addr,
-			},
-			{
-				Name:  "VAULT_PATH",
-				Value: vaultConfig.Path,
-			},
-			{
-				Name:  "VAULT_ROLE",
-				Value: vaultConfig.Role,
-			}, {
-				Name:  "VAULT_CAPATH",
-				Value: "/etc/tls/ca.pem",
-			},
-		}...)
+		// the files directory is already mounted with the vault-env volume
+		if hasSecretFiles(vaultConfig) && vaultConfig.FileMountPath != "" {
+			volumeMounts = append(volumeMounts, secretFilesMounts(vaultConfig, names)...)
+		}
+
+		if refreshesFiles {
+			filesEnv, filesMounts, err := secretFilesConfig(vaultConfig, names)
+			if err != nil {
+				return nil, err
+			}
+			env = append(env, filesEnv...)
+			volumeMounts = append(volumeMounts, filesMounts...)
+		}
+
+		if vaultConfig.Supervise {
+			env = append(env, corev1.EnvVar{
+				Name:  "VAULT_ENV_SUPERVISE",
+				Value: "true",
+			})
+		}
+
+		if vaultConfig.WatchInterval != "" {
+			env = append(env, []corev1.EnvVar{
+				{
+					Name:  "VAULT_WATCH_INTERVAL",
+					Value: vaultConfig.WatchInterval,
+				}, {
+					Name:  "VAULT_WATCH_ACTION",
+					Value: vaultConfig.WatchAction,
+				}, {
+					Name:  "VAULT_WATCH_SIGNAL",
+					Value: vaultConfig.WatchSignal,
+				},
+			}...)
+		}
+
+		container.Env = mergeEnvVars(container.Env, env)
+		container.VolumeMounts = mergeVolumeMounts(container.VolumeMounts, volumeMounts)
 
 		containers[i] = container
 	}
 	return mutated, nil
 }
 
-// MutatePodSpec mutate the given pod spec
-func MutatePodSpec(obj metav1.Object, podSpec *corev1.PodSpec, vaultConfig VaultConfig, ns string) error {
-	fmt.Println("starting mutation chain for pod spec")
-	initContainersMutated, err := mutateContainers(podSpec.InitContainers, vaultConfig, ns)
+// vaultEnvConfig transforms the pod annotations to the env vars and volume mounts vault-env
+// needs to log in to Vault and read secrets
+func vaultEnvConfig(vaultConfig VaultConfig, names injectedNames) ([]corev1.EnvVar, []corev1.VolumeMount) {
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      names.TLSVolume,
+			MountPath: names.TLSMountPath,
+		},
+	}
+
+	env := []corev1.EnvVar{
+		{
+			Name:  "VAULT_ADDR",
+			Value: vaultConfig.Addr,
+		},
+		{
+			Name:  "VAULT_PATH",
+			Value: vaultConfig.Path,
+		},
+		{
+			Name:  "VAULT_ROLE",
+			Value: vaultConfig.Role,
+		}, {
+			Name:  "VAULT_CAPATH",
+			Value: names.caPath(),
+		},
+	}
+
+	if vaultConfig.AuthPath != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_AUTH_PATH",
+			Value: vaultConfig.AuthPath,
+		})
+	}
+
+	if vaultConfig.AuthMethod != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_AUTH_METHOD",
+			Value: vaultConfig.AuthMethod,
+		})
+	}
+
+	if vaultConfig.VaultNamespace != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_NAMESPACE",
+			Value: vaultConfig.VaultNamespace,
+		})
+	}
+
+	if projectsServiceAccountToken(vaultConfig) {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_SA_TOKEN_FILE",
+			Value: names.tokenPath(),
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      names.TokenVolume,
+			MountPath: names.TokenMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	credentialsEnv, credentialsMounts := authCredentialsConfig(vaultConfig, names)
+	env = append(env, credentialsEnv...)
+	volumeMounts = append(volumeMounts, credentialsMounts...)
+
+	// vault-env enforces the allowlist again on the address it actually logs in to
+	if allowlist := viper.GetString("vault_addr_allowlist"); allowlist != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_ADDR_ALLOWLIST",
+			Value: allowlist,
+		})
+	}
+
+	// ConfigMaps and Secrets of the env and templates are read again at every start, vault-env
+	// rejects paths that weren't authorized at admission
+	if vaultConfig.AllowedPaths != nil {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_ALLOWED_PATHS",
+			Value: strings.Join(vaultConfig.AllowedPaths, ","),
+		})
+	}
+
+	if format := viper.GetString("vault_env_log_format"); format != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_ENV_LOG_FORMAT",
+			Value: format,
+		})
+	}
+
+	if level := viper.GetString("vault_env_log_level"); level != "" {
+		env = append(env, corev1.EnvVar{
+			Name:  "VAULT_ENV_LOG_LEVEL",
+			Value: level,
+		})
+	}
+
+	return env, volumeMounts
+}
+
+// MutatePodSpec mutate the given pod spec, mutating an already mutated pod spec again is a no-op
+func MutatePodSpec(ctx context.Context, obj metav1.Object, podSpec *corev1.PodSpec, vaultConfig VaultConfig, ns string) error {
+	names, err := resolveInjectedNames(podSpec, vaultConfig)
+	if err != nil {
+		return reject("injection_conflict", err)
+	}
+
+	// only pods are rejected for missing ConfigMaps and Secrets, they would never start
+	_, isPod := obj.(*corev1.Pod)
+	sources := newEnvSources(kubeClient, ns, !isPod)
+	if err := validateVaultAddr(vaultConfig, podSpec, sources); err != nil {
+		return reject("vault_addr_not_allowed", err)
+	}
+	allowedPaths, err := authorizePolicy(podSpec, vaultConfig, sources, ns)
+	if err != nil {
+		return err
+	}
+	vaultConfig.AllowedPaths = allowedPaths
+	vaultConfig = withDefaultFileOwner(podSpec, vaultConfig)
+
+	// the image lookups of all containers must end before the API server stops waiting for the
+	// admission, registry_timeout is kept below the timeoutSeconds of the webhook
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("registry_timeout"))
+	defer cancel()
+
+	initContainersMutated, err := mutateContainers(ctx, podSpec.InitContainers, podSpec, vaultConfig, names, sources, ns)
 	if err != nil {
 		return err
 	}
 
-	containersMutated, err := mutateContainers(podSpec.Containers, vaultConfig, ns)
+	containersMutated, err := mutateContainers(ctx, podSpec.Containers, podSpec, vaultConfig, names, sources, ns)
 	if err != nil {
 		return err
 	}
 
-	if initContainersMutated || containersMutated {
-		podSpec.InitContainers = append(getInitContainers(vaultConfig), podSpec.InitContainers...)
-		podSpec.Volumes = append(podSpec.Volumes, getVolumes(vaultConfig)...)
+	if len(initContainersMutated) > 0 || len(containersMutated) > 0 || hasSecretFiles(vaultConfig) {
+		status := injectionStatus{
+			Version:        injectionVersion,
+			Containers:     append(initContainersMutated, containersMutated...),
+			InitContainers: []string{},
+			Volumes:        []string{},
+		}
+
+		injectedInitContainers, err := getInitContainers(vaultConfig, names)
+		if err != nil {
+			return err
+		}
+		// init containers injected before are rendered again, e.g. with the env of the pod
+		var initContainers []corev1.Container
+		for _, container := range injectedInitContainers {
+			if i := containerIndex(podSpec.InitContainers, container.Name); i >= 0 {
+				podSpec.InitContainers[i] = container
+			} else {
+				initContainers = append(initContainers, container)
+			}
+			status.InitContainers = append(status.InitContainers, container.Name)
+		}
+		podSpec.InitContainers = append(initContainers, podSpec.InitContainers...)
+
+		for _, volume := range getVolumes(vaultConfig, names) {
+			if !hasVolume(podSpec.Volumes, volume.Name) {
+				podSpec.Volumes = append(podSpec.Volumes, volume)
+			}
+			status.Volumes = append(status.Volumes, volume.Name)
+		}
+
+		return setInjectionStatus(obj, status)
 	}
 
 	return nil
 }
 
-func parseVaultConfig(obj metav1.Object) VaultConfig {
+// parseVaultConfig reads the vault annotations of obj, falling back to the annotations of its namespace
+func parseVaultConfig(obj metav1.Object, namespace string) VaultConfig {
 	var vaultConfig VaultConfig
-	annotations := obj.GetAnnotations()
+	annotations := mergeNamespaceAnnotations(namespace, obj.GetAnnotations())
 
 	vaultConfig.Addr = annotations["vault.security/vault-addr"]
 	vaultConfig.Role = annotations["vault.security/vault-role"]
 	vaultConfig.Path = annotations["vault.security/vault-path"]
+	vaultConfig.AuthPath = annotations["vault.security/vault-auth-path"]
+	vaultConfig.AuthMethod = annotations["vault.security/vault-auth-method"]
+	vaultConfig.VaultNamespace = annotations["vault.security/vault-namespace"]
+	vaultConfig.AuthSecretName = annotations["vault.security/vault-auth-secret-name"]
+	vaultConfig.RoleIDFile = annotations["vault.security/vault-role-id-file"]
+	vaultConfig.SecretIDFile = annotations["vault.security/vault-secret-id-file"]
+	vaultConfig.TokenFile = annotations["vault.security/vault-token-file"]
+	vaultConfig.JWTFile = annotations["vault.security/vault-jwt-file"]
+	vaultConfig.ClientCertFile = annotations["vault.security/vault-client-cert-file"]
+	vaultConfig.ClientKeyFile = annotations["vault.security/vault-client-key-file"]
 	vaultConfig.Enabled, _ = strconv.ParseBool(annotations["vault.security/enabled"])
 	vaultConfig.TLSSecretName = annotations["vault.security/vault-tls-secret-name"]
+	vaultConfig.Supervise, _ = strconv.ParseBool(annotations["vault.security/supervise"])
+	vaultConfig.WatchInterval = annotations["vault.security/watch-interval"]
+	vaultConfig.WatchAction = annotations["vault.security/watch-action"]
+	vaultConfig.WatchSignal = annotations["vault.security/watch-signal"]
+	vaultConfig.Files = parseSecretFiles(annotations)
+	vaultConfig.FileMountPath = annotations["vault.security/file-mount-path"]
+	vaultConfig.FileMode = annotations["vault.security/file-mode"]
+	vaultConfig.FileOwner = annotations["vault.security/file-owner"]
+	vaultConfig.Templates = parseTemplates(annotations)
+	vaultConfig.TemplateConfigMap = annotations["vault.security/template-configmap"]
+	vaultConfig.TokenProjection = viper.GetBool("service_account_token_projection")
+	if value, ok := annotations["vault.security/service-account-token-projection"]; ok {
+		vaultConfig.TokenProjection, _ = strconv.ParseBool(value)
+	}
+	vaultConfig.TokenAudience = annotations["vault.security/service-account-token-audience"]
+	vaultConfig.TokenExpiration = annotations["vault.security/service-account-token-expiration"]
+
+	// watching secrets requires vault-env to supervise the command
+	if vaultConfig.WatchInterval != "" {
+		vaultConfig.Supervise = true
+	}
 
 	return vaultConfig
 }
 
-// VaultSecretsMutator if object is Pod mutate pod specs
-// return a stop boolean to stop executing the chain and also an error.
-func VaultSecretsMutator(ctx context.Context, obj metav1.Object) (bool, error) {
-	var podSpec *corev1.PodSpec
-	var namespace string
+// requestNamespace returns the namespace of obj, if not found the admission request namespace
+func requestNamespace(ctx context.Context, obj metav1.Object) string {
+	if ns := obj.GetNamespace(); len(ns) > 0 {
+		return ns
+	}
+	if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+		return ar.Namespace
+	}
+	return ""
+}
 
+// getPodSpec returns the pod spec and the metadata holding the vault annotations
+// for pods and for workloads with a pod template
+func getPodSpec(obj metav1.Object) (metav1.Object, *corev1.PodSpec) {
 	switch v := obj.(type) {
 	case *corev1.Pod:
-		podSpec = &v.Spec
+		return v, &v.Spec
+	case *appsv1.Deployment:
+		return &v.Spec.Template.ObjectMeta, &v.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return &v.Spec.Template.ObjectMeta, &v.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return &v.Spec.Template.ObjectMeta, &v.Spec.Template.Spec
+	case *batchv1.Job:
+		return &v.Spec.Template.ObjectMeta, &v.Spec.Template.Spec
+	case *batchv1beta1.CronJob:
+		return &v.Spec.JobTemplate.Spec.Template.ObjectMeta, &v.Spec.JobTemplate.Spec.Template.Spec
 	default:
-		return false, nil
+		return nil, nil
 	}
+}
 
-	vaultConfig := parseVaultConfig(obj)
+// watchSignals are the signals vault-env can send on a secret change, see vault-env/watcher.go
+var watchSignals = map[string]bool{
+	"SIGHUP":  true,
+	"SIGINT":  true,
+	"SIGQUIT": true,
+	"SIGTERM": true,
+	"SIGUSR1": true,
+	"SIGUSR2": true,
+}
 
-	// Get namespace from object, if not found check addmission request namespace
-	ns := obj.GetNamespace()
-	if len(ns) > 0 {
-		namespace = ns
-	} else {
-		namespace = whcontext.GetAdmissionRequest(ctx).Namespace
+func validateWatchConfig(vaultConfig VaultConfig) error {
+	if vaultConfig.WatchInterval == "" {
+		return nil
+	}
+	if interval, err := time.ParseDuration(vaultConfig.WatchInterval); err != nil || interval <= 0 {
+		return fmt.Errorf("Error parsing watch interval %q - \"vault.security/watch-interval\" must be a positive duration like 1m", vaultConfig.WatchInterval)
+	}
+	switch vaultConfig.WatchAction {
+	case "", "signal", "restart", "exit":
+	default:
+		return fmt.Errorf("Error parsing watch action %q - \"vault.security/watch-action\" must be one of signal, restart, exit", vaultConfig.WatchAction)
+	}
+	if vaultConfig.WatchSignal != "" {
+		signal := strings.ToUpper(vaultConfig.WatchSignal)
+		if !strings.HasPrefix(signal, "SIG") {
+			signal = "SIG" + signal
+		}
+		if !watchSignals[signal] {
+			return fmt.Errorf("Error parsing watch signal %q - \"vault.security/watch-signal\" must be one of SIGHUP, SIGINT, SIGQUIT, SIGTERM, SIGUSR1, SIGUSR2", vaultConfig.WatchSignal)
+		}
 	}
+	return nil
+}
+
+// isKubernetesAuth reports whether method is the default kubernetes auth method
+func isKubernetesAuth(method string) bool {
+	return method == "" || method == "kubernetes"
+}
+
+// authMethodRequiresRole reports whether vault-env logs in to method with VAULT_ROLE,
+// approle, cert and token logins work without one
+func authMethodRequiresRole(method string) bool {
+	return isKubernetesAuth(method) || method == "jwt"
+}
+
+func validateAuthMethod(vaultConfig VaultConfig) error {
+	switch vaultConfig.AuthMethod {
+	case "", "kubernetes", "jwt", "approle", "cert", "token":
+		return nil
+	default:
+		return fmt.Errorf("Error parsing vault auth method %q - \"vault.security/vault-auth-method\" must be one of kubernetes, jwt, approle, cert, token", vaultConfig.AuthMethod)
+	}
+}
+
+// authPathRegexp matches auth/<mount> with mount path segments of letters, digits, _, - and .
+var authPathRegexp = regexp.MustCompile(`^auth(/[A-Za-z0-9_-][A-Za-z0-9_.-]*)+$`)
+
+// validateAuthPath checks the auth path is an auth/<mount> path vault-env can append /login to
+func validateAuthPath(vaultConfig VaultConfig) error {
+	if vaultConfig.AuthPath == "" {
+		return nil
+	}
+	if !authPathRegexp.MatchString(strings.Trim(vaultConfig.AuthPath, "/")) {
+		return fmt.Errorf("Error parsing vault auth path %q - \"vault.security/vault-auth-path\" must be the mount path of an auth method like auth/kubernetes", vaultConfig.AuthPath)
+	}
+	return nil
+}
+
+// vaultNamespaceRegexp matches Vault namespace paths like team-a or org/team-a
+var vaultNamespaceRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*(/[A-Za-z0-9_-][A-Za-z0-9_.-]*)*$`)
+
+// validateVaultNamespace checks the namespace is a Vault namespace path vault-env can send
+// in the X-Vault-Namespace header
+func validateVaultNamespace(namespace string) error {
+	if namespace == "" {
+		return nil
+	}
+	if !vaultNamespaceRegexp.MatchString(strings.Trim(namespace, "/")) {
+		return fmt.Errorf("Error parsing vault namespace %q - it must be a namespace path like team-a or org/team-a", namespace)
+	}
+	return nil
+}
+
+// VaultSecretsMutator if object is Pod or a workload with a pod template mutate pod specs
+// return a stop boolean to stop executing the chain and also an error.
+func VaultSecretsMutator(ctx context.Context, obj metav1.Object) (bool, error) {
+	podMeta, podSpec := getPodSpec(obj)
+	if podSpec == nil {
+		return false, nil
+	}
+
+	namespace := requestNamespace(ctx, obj)
+	vaultConfig := parseVaultConfig(podMeta, namespace)
 
 	/// Verify all annotations ar set
 	if vaultConfig.Enabled {
+		if err := applyVaultDefaults(&vaultConfig, newVaultTemplateData(obj, podMeta, podSpec, namespace)); err != nil {
+			return true, reject("invalid_defaults", err)
+		}
+
 		if vaultConfig.Addr == "" {
-			return true, fmt.Errorf("Error getting vault address - make sure you set the annotation \"vault.security/enabled\" on the Pod")
+			return true, reject("missing_vault_addr", fmt.Errorf("Error getting vault address - make sure you set the annotation \"vault.security/enabled\" on the Pod"))
 		}
 		if vaultConfig.TLSSecretName == "" {
-			return true, fmt.Errorf("Error getting vault TLS secret name - make sure you set the annotation \"vault.security/vault-tls-secret-name\"")
+			return true, reject("missing_vault_tls_secret_name", fmt.Errorf("Error getting vault TLS secret name - make sure you set the annotation \"vault.security/vault-tls-secret-name\""))
 		}
-		if vaultConfig.Path == "" {
-			return true, fmt.Errorf("Error getting vault path - make sure you set the annotation \"vault.security/vault-path\"")
+		if err := validateAuthMethod(vaultConfig); err != nil {
+			return true, reject("invalid_vault_auth_method", err)
 		}
-		if vaultConfig.Role == "" {
-			return true, fmt.Errorf("Error getting vault role - make sure you set the annotation \"vault.security/vault-role\"")
+		if vaultConfig.Role == "" && authMethodRequiresRole(vaultConfig.AuthMethod) {
+			return true, reject("missing_vault_role", fmt.Errorf("Error getting vault role - make sure you set the annotation \"vault.security/vault-role\""))
 		}
 		if vaultConfig.Addr == "" {
-			return true, fmt.Errorf("Error getting vault address - make sure you set the annotation \"vault.security/vault-addr\"")
+			return true, reject("missing_vault_addr", fmt.Errorf("Error getting vault address - make sure you set the annotation \"vault.security/vault-addr\""))
+		}
+
+		if err := validateWatchConfig(vaultConfig); err != nil {
+			return true, reject("invalid_watch_config", err)
+		}
+		if err := validateAuthCredentials(vaultConfig); err != nil {
+			return true, reject("invalid_vault_auth_credentials", err)
+		}
+		if err := validateAuthPath(vaultConfig); err != nil {
+			return true, reject("invalid_vault_auth_path", err)
+		}
+		if err := validateVaultNamespace(vaultConfig.VaultNamespace); err != nil {
+			return true, reject("invalid_vault_namespace", err)
+		}
+		if err := projectTokenWithoutAutomount(&vaultConfig, podSpec, namespace); err != nil {
+			return true, reject("invalid_service_account_token", err)
+		}
+		if err := validateServiceAccountToken(vaultConfig); err != nil {
+			return true, reject("invalid_service_account_token", err)
+		}
+		if err := validateSecretFiles(vaultConfig); err != nil {
+			return true, reject("invalid_secret_files", err)
+		}
+		if err := validateTemplates(vaultConfig); err != nil {
+			return true, reject("invalid_templates", err)
 		}
 
-		return false, MutatePodSpec(obj, podSpec, vaultConfig, namespace)
+		requestLogger(ctx, obj).Debug("starting mutation chain for pod spec")
+		return false, MutatePodSpec(ctx, podMeta, podSpec, vaultConfig, namespace)
 	}
 	// If there's no annotation of  "vault.security/enabled", continue the mutation chain(if there is one) and don't do nothing.
 	return false, nil
@@ -225,19 +714,63 @@ func VaultSecretsMutator(ctx context.Context, obj metav1.Object) (bool, error) {
 // InitConfig init flags with viper
 func InitConfig() {
 	viper.SetDefault("vault_env_image", "innovia/vault-env:1.1.0")
+	viper.SetDefault("injected_name_prefix", "vault-")
+	viper.SetDefault("vault_env_mount_path", "/vault")
+	viper.SetDefault("vault_tls_mount_path", "/etc/tls")
+	viper.SetDefault("vault_token_mount_path", "/var/run/secrets/vault")
+	viper.SetDefault("vault_auth_mount_path", "/var/run/secrets/vault-auth")
+	viper.SetDefault("service_account_token_projection", false)
+	viper.SetDefault("service_account_token_audience", "vault")
+	viper.SetDefault("service_account_token_expiration", "10m")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_format", "json")
+	viper.SetDefault("vault_env_log_format", "")
+	viper.SetDefault("vault_env_log_level", "")
+	viper.SetDefault("metrics_listen_address", ":8080")
+	viper.SetDefault("readiness_vault_check", false)
+	viper.SetDefault("readiness_vault_ca_file", "")
+	viper.SetDefault("self_managed_certs", false)
+	viper.SetDefault("self_managed_certs_namespace", "")
+	viper.SetDefault("self_managed_certs_secret_name", "vault-secrets-webhook-certs")
+	viper.SetDefault("self_managed_certs_service_name", "vault-secrets-webhook")
+	viper.SetDefault("self_managed_certs_webhook_config_name", "vault-secrets-webhook")
+	viper.SetDefault("self_managed_certs_validity", "8760h")
+	viper.SetDefault("self_managed_certs_renew_before", "720h")
+	viper.SetDefault("self_managed_certs_check_interval", "1h")
+	viper.SetDefault("policy_file", "")
+	viper.SetDefault("vault_addr_allowlist", "")
+	viper.SetDefault("registry_timeout", "10s")
+	viper.SetDefault("registry_cache_ttl", "1h")
+	viper.SetDefault("registry_platform", defaultPlatform)
+	viper.SetDefault("registry_insecure_hosts", "")
+	viper.SetDefault("default_vault_addr", "")
+	viper.SetDefault("default_vault_auth_path", "")
+	viper.SetDefault("default_vault_auth_method", "")
+	viper.SetDefault("default_vault_namespace", "")
+	viper.SetDefault("default_vault_tls_secret_name", "")
+	viper.SetDefault("default_vault_role_template", "")
+	viper.SetDefault("default_vault_path_template", "")
 	viper.AutomaticEnv()
+
+	imageRegistry = NewImageRegistry(viper.GetDuration("registry_timeout"), viper.GetDuration("registry_cache_ttl"))
+	imageRegistry.Platform = viper.GetString("registry_platform")
+	for _, host := range strings.Split(viper.GetString("registry_insecure_hosts"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			imageRegistry.InsecureRegistries = append(imageRegistry.InsecureRegistries, host)
+		}
+	}
 }
 
-func handlerFor(config mutating.WebhookConfig, mutator mutating.Mutator, logger log.Logger) http.Handler {
-	webhook, err := mutating.NewWebhook(config, mutator, nil, nil, logger)
+func handlerFor(config mutating.WebhookConfig, mutator mutating.Mutator, recorder metrics.Recorder, logger log.Logger) http.Handler {
+	webhook, err := mutating.NewWebhook(config, mutator, nil, recorder, logger)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error creating webhook: %s", err)
+		logger.Errorf("error creating webhook: %s", err)
 		os.Exit(1)
 	}
 
 	handler, err := whhttp.HandlerFor(webhook)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error creating webhook: %s", err)
+		logger.Errorf("error creating webhook: %s", err)
 		os.Exit(1)
 	}
 
@@ -248,29 +781,163 @@ func handlerFor(config mutating.WebhookConfig, mutator mutating.Mutator, logger
 func Main() {
 	InitConfig()
 
-	logger := &log.Std{Debug: viper.GetBool("debug")}
+	level := viper.GetString("log_level")
+	if viper.GetBool("debug") {
+		level = "debug"
+	}
+	l, err := NewLogger(level, viper.GetString("log_format"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating logger: %s", err)
+		os.Exit(1)
+	}
+	SetLogger(l)
+
+	if err := validateVaultEnvLogging(viper.GetString("vault_env_log_format"), viper.GetString("vault_env_log_level")); err != nil {
+		logger.Fatalf("error validating vault-env logging: %s", err)
+	}
+
+	p, err := LoadPolicy(viper.GetString("policy_file"))
+	if err != nil {
+		logger.Fatalf("error loading policy: %s", err)
+	}
+	SetPolicy(p)
+
+	if _, err := vaultAddrAllowlist(); err != nil {
+		logger.Fatalf("error loading vault address allowlist: %s", err)
+	}
+
+	if timeout := viper.GetDuration("registry_timeout"); timeout <= 0 {
+		logger.Fatalf("error validating registry timeout: %q must be a positive duration below the webhook's timeoutSeconds", viper.GetString("registry_timeout"))
+	}
+
+	client, err := newClientSet()
+	if err != nil {
+		logger.Warningf("error creating kubernetes client, imagePullSecrets and namespace defaults will not be used: %s", err)
+	} else {
+		SetKubernetesClient(client)
+
+		if err := StartNamespaceInformer(client, make(chan struct{})); err != nil {
+			logger.Warningf("error starting namespace informer, namespace defaults will not be used: %s", err)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	if err := RegisterMetrics(registry); err != nil {
+		logger.Fatalf("error registering metrics: %s", err)
+	}
+	recorder := metrics.NewPrometheus(registry)
 
-	mutator := mutating.MutatorFunc(VaultSecretsMutator)
+	mutator := InstrumentMutator(VaultSecretsMutator)
 
 	podHandler := handlerFor(
 		mutating.WebhookConfig{Name: "vault-secrets-webhook-pods", Obj: &corev1.Pod{}},
 		mutator,
+		recorder,
+		logger,
+	)
+	deploymentHandler := handlerFor(
+		mutating.WebhookConfig{Name: "vault-secrets-webhook-deployments", Obj: &appsv1.Deployment{}},
+		mutator,
+		recorder,
+		logger,
+	)
+	statefulSetHandler := handlerFor(
+		mutating.WebhookConfig{Name: "vault-secrets-webhook-statefulsets", Obj: &appsv1.StatefulSet{}},
+		mutator,
+		recorder,
+		logger,
+	)
+	daemonSetHandler := handlerFor(
+		mutating.WebhookConfig{Name: "vault-secrets-webhook-daemonsets", Obj: &appsv1.DaemonSet{}},
+		mutator,
+		recorder,
+		logger,
+	)
+	jobHandler := handlerFor(
+		mutating.WebhookConfig{Name: "vault-secrets-webhook-jobs", Obj: &batchv1.Job{}},
+		mutator,
+		recorder,
+		logger,
+	)
+	cronJobHandler := handlerFor(
+		mutating.WebhookConfig{Name: "vault-secrets-webhook-cronjobs", Obj: &batchv1beta1.CronJob{}},
+		mutator,
+		recorder,
 		logger,
 	)
 
 	mux := http.NewServeMux()
 	mux.Handle("/pods", podHandler)
+	mux.Handle("/deployments", deploymentHandler)
+	mux.Handle("/statefulsets", statefulSetHandler)
+	mux.Handle("/daemonsets", daemonSetHandler)
+	mux.Handle("/jobs", jobHandler)
+	mux.Handle("/cronjobs", cronJobHandler)
+
+	if viper.GetBool("self_managed_certs") {
+		if kubeClient == nil {
+			logger.Fatalf("error managing certificates: a kubernetes client is required")
+		}
 
-	logger.Infof("Listening with TLS on :8443")
-	err := http.ListenAndServeTLS(
-		":8443",
-		viper.GetString("tls_cert_file"),
-		viper.GetString("tls_private_key_file"),
-		mux,
-	)
+		certs := NewSelfManagedCerts(kubeClient, SelfManagedCertsConfig{
+			Namespace:         viper.GetString("self_managed_certs_namespace"),
+			SecretName:        viper.GetString("self_managed_certs_secret_name"),
+			ServiceName:       viper.GetString("self_managed_certs_service_name"),
+			WebhookConfigName: viper.GetString("self_managed_certs_webhook_config_name"),
+			CertFile:          viper.GetString("tls_cert_file"),
+			KeyFile:           viper.GetString("tls_private_key_file"),
+			Validity:          viper.GetDuration("self_managed_certs_validity"),
+			RenewBefore:       viper.GetDuration("self_managed_certs_renew_before"),
+		}, logger)
+		if err := certs.Ensure(); err != nil {
+			logger.Fatalf("error managing certificates: %s", err)
+		}
+		go certs.Run(viper.GetDuration("self_managed_certs_check_interval"), make(chan struct{}))
+	}
+
+	certWatcher, err := NewCertWatcher(viper.GetString("tls_cert_file"), viper.GetString("tls_private_key_file"), logger)
 	if err != nil {
+		logger.Fatalf("error loading TLS key pair: %s", err)
+	}
+	if err := certWatcher.Start(make(chan struct{})); err != nil {
+		logger.Warningf("error watching TLS key pair, certificate rotation needs a restart: %s", err)
+	}
 
-		fmt.Fprintf(os.Stderr, "error serving webhook: %s", err)
-		os.Exit(1)
+	checks := []HealthCheck{
+		TLSKeyPairCheck(certWatcher),
+		KubernetesAPICheck(kubeClient),
+	}
+	if viper.GetBool("readiness_vault_check") && viper.GetString("default_vault_addr") != "" {
+		check, err := VaultHealthCheck(viper.GetString("default_vault_addr"), viper.GetString("readiness_vault_ca_file"))
+		if err != nil {
+			logger.Fatalf("error creating vault readiness check: %s", err)
+		}
+		checks = append(checks, check)
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metricsHandler(registry))
+	metricsMux.Handle("/healthz", HealthzHandler())
+	metricsMux.Handle("/readyz", ReadyzHandler(checks...))
+
+	metricsAddr := viper.GetString("metrics_listen_address")
+	go func() {
+		logger.Infof("Listening for metrics and health checks on %s", metricsAddr)
+		if err := http.ListenAndServe(metricsAddr, metricsMux); err != nil {
+			logger.Fatalf("error serving metrics: %s", err)
+		}
+	}()
+
+	server := &http.Server{
+		Addr:      ":8443",
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: certWatcher.GetCertificate},
+	}
+
+	logger.Infof("Listening with TLS on :8443")
+	err = server.ListenAndServeTLS("", "")
+	if err != nil {
+		logger.Fatalf("error serving webhook: %s", err)
 	}
 }